@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"wxGateway/wechat"
+)
+
+//微信服务器请求的timestamp与本机时间允许的最大偏差
+var callbackTimestampSkew = 5 * time.Minute
+
+//微信5秒内收不到被动回复会断开并重试，超过这个时间先回复success
+var callbackReplyTimeout = 4 * time.Second
+
+//微信服务器配置的接入验证和消息推送，没有配置token时不注册，空token的签名任何人都能算出来
+func initCallback(engine *gin.Engine) {
+	if callbackToken == "" {
+		log.Warn("微信服务器token为空，不接收微信推送")
+		return
+	}
+	engine.GET("/wechat/callback", validateCallback, func(context *gin.Context) {
+		echostr := context.Query("echostr")
+		log.WithFields(logrus.Fields{"echostr": echostr}).Info("微信服务器接入验证")
+		context.String(http.StatusOK, echostr)
+	})
+	engine.POST("/wechat/callback", validateCallback, func(context *gin.Context) {
+		data, err := readCallbackMessage(context)
+		if err != nil {
+			context.String(http.StatusBadRequest, "")
+			return
+		}
+		message, err := wechat.ParseMessage(data)
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err, "body": string(data)}).Error("解析微信推送消息失败")
+			context.String(http.StatusBadRequest, "")
+			return
+		}
+		log.WithFields(logrus.Fields{"message": message}).Info("收到微信推送消息")
+		key := callbackMessageKey(message)
+		if !callbackMessages.add(key) {
+			log.WithFields(logrus.Fields{"key": key}).Info("忽略微信重试推送的消息")
+			writeCallbackReply(context, nil)
+			return
+		}
+		dispatchEvent(message)
+		replyChannel := make(chan wechat.Reply, 1)
+		go func() {
+			replyChannel <- replyMessage(message)
+		}()
+		select {
+		case result := <-replyChannel:
+			reply, err := wechat.BuildReply(message, result, time.Now().Unix())
+			if err != nil {
+				log.WithFields(logrus.Fields{"err": err}).Error("生成被动回复失败")
+			}
+			writeCallbackReply(context, reply)
+		case <-time.After(callbackReplyTimeout):
+			log.WithFields(logrus.Fields{"key": key}).Warn("处理微信推送超时，先回复success再用客服消息回复")
+			go sendCustomReply(message, replyChannel)
+			writeCallbackReply(context, nil)
+		}
+	})
+}
+
+//同步webhook优先，没有回复时匹配自动回复规则
+func replyMessage(message *wechat.Message) wechat.Reply {
+	reply := relayWebhooks(context.Background(), message)
+	if reply == nil {
+		reply = rules.matchReply(message)
+	}
+	return reply
+}
+
+//等处理完成后把被动回复改为客服消息发给用户
+func sendCustomReply(message *wechat.Message, replyChannel chan wechat.Reply) {
+	reply := <-replyChannel
+	if reply == nil {
+		return
+	}
+	customMessage, ok := wechat.ReplyToCustomMessage(message.FromUserName, reply)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	err := sendCustomMessage(ctx, customMessage)
+	if err != nil {
+		log.WithFields(logrus.Fields{"openId": message.FromUserName, "err": err}).Error("用客服消息回复失败")
+	}
+}
+
+//消息用MsgId排重，事件用FromUserName+CreateTime排重
+//同一秒内同一个用户可能有多条模板消息的发送结果，带MsgID的事件加上MsgID
+func callbackMessageKey(message *wechat.Message) string {
+	if message.MsgId != 0 {
+		return "msg:" + strconv.FormatInt(message.MsgId, 10)
+	}
+	key := "event:" + message.FromUserName + ":" + strconv.FormatInt(message.CreateTime, 10) + ":" + message.Event
+	if message.MsgID != 0 {
+		key += ":" + strconv.FormatInt(message.MsgID, 10)
+	}
+	return key
+}
+
+//微信5秒内收不到回复会重试，最多推送3次
+type messageDedup struct {
+	ttl     time.Duration
+	mutex   sync.Mutex
+	expires map[string]time.Time
+	sweepAt time.Time
+}
+
+var callbackMessages = newMessageDedup(time.Minute)
+
+func newMessageDedup(ttl time.Duration) *messageDedup {
+	return &messageDedup{ttl: ttl, expires: map[string]time.Time{}}
+}
+
+//第一次出现时返回true，ttl内再次出现返回false
+func (dedup *messageDedup) add(key string) bool {
+	dedup.mutex.Lock()
+	defer dedup.mutex.Unlock()
+	now := time.Now()
+	if now.After(dedup.sweepAt) {
+		for expiredKey, expireAt := range dedup.expires {
+			if now.After(expireAt) {
+				delete(dedup.expires, expiredKey)
+			}
+		}
+		dedup.sweepAt = now.Add(dedup.ttl)
+	}
+	if expireAt, ok := dedup.expires[key]; ok && now.Before(expireAt) {
+		return false
+	}
+	dedup.expires[key] = now.Add(dedup.ttl)
+	return true
+}
+
+//安全模式和兼容模式下微信会带上encrypt_type=aes，此时以Encrypt中的密文为准
+func isEncryptedCallback(context *gin.Context) bool {
+	return context.Query("encrypt_type") == "aes"
+}
+
+//读取微信推送的消息，加密时校验msg_signature并解密
+func readCallbackMessage(context *gin.Context) ([]byte, error) {
+	data, err := ioutil.ReadAll(context.Request.Body)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("读取微信推送消息失败")
+		return nil, err
+	}
+	if !isEncryptedCallback(context) {
+		return data, nil
+	}
+	if msgCrypt == nil {
+		log.Error("收到加密消息但没有配置EncodingAESKey")
+		return nil, errors.New("没有配置EncodingAESKey")
+	}
+	data, err = msgCrypt.DecryptMessage(context.Query("msg_signature"), context.Query("timestamp"), context.Query("nonce"), data)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("解密微信推送消息失败")
+		return nil, err
+	}
+	return data, nil
+}
+
+//被动回复微信，reply为空时回复success，加密推送的回复同样加密
+func writeCallbackReply(context *gin.Context, reply []byte) {
+	if len(reply) == 0 {
+		context.String(http.StatusOK, "success")
+		return
+	}
+	if isEncryptedCallback(context) && msgCrypt != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		encrypted, err := msgCrypt.EncryptMessage(reply, timestamp, context.Query("nonce"))
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("加密被动回复失败")
+			context.String(http.StatusOK, "success")
+			return
+		}
+		reply = encrypted
+	}
+	log.WithFields(logrus.Fields{"reply": string(reply)}).Info("被动回复微信")
+	context.Data(http.StatusOK, "application/xml; charset=utf-8", reply)
+}
+
+//校验请求确实来自微信服务器
+func validateCallback(context *gin.Context) {
+	signature := context.Query("signature")
+	timestamp := context.Query("timestamp")
+	nonce := context.Query("nonce")
+	if callbackToken == "" {
+		log.Warn("微信服务器token为空，拒绝微信推送")
+		context.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if !wechat.CheckSignature(callbackToken, signature, timestamp, nonce) {
+		log.WithFields(logrus.Fields{"signature": signature, "timestamp": timestamp, "nonce": nonce}).Warn("微信推送签名非法")
+		context.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	skew := time.Since(time.Unix(seconds, 0))
+	if err != nil || skew > callbackTimestampSkew || skew < -callbackTimestampSkew {
+		log.WithFields(logrus.Fields{"timestamp": timestamp}).Warn("微信推送timestamp过期")
+		context.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	context.Next()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"wxGateway/mock"
+)
+
+var address = ":8991"
+var log = logrus.New()
+
+//启动模拟微信接口服务，网关配置API_URL指向本服务即可脱离真实公众号运行
+func main() {
+	appId := os.Getenv("APP_ID")
+	appSecret := os.Getenv("APP_SECRET")
+	if a := os.Getenv("MOCK_ADDRESS"); a != "" {
+		address = a
+	}
+	log.WithFields(logrus.Fields{"address": address, "appId": appId}).Info("开始模拟微信接口服务")
+
+	server := mock.NewServer(appId, appSecret)
+	server.AddTemplate("mock_template", "模拟模板")
+	server.AddUser("mock_openid_1", "mock_user_1")
+	server.AddUser("mock_openid_2", "mock_user_2")
+	server.AddUser("mock_openid_3", "mock_user_3")
+	//压测时用MOCK_USER_COUNT增加更多用户
+	userCount, _ := strconv.Atoi(os.Getenv("MOCK_USER_COUNT"))
+	for i := 4; i <= userCount; i++ {
+		server.AddUser("mock_openid_"+strconv.Itoa(i), "mock_user_"+strconv.Itoa(i))
+	}
+	server.ExpireInteraction("mock_openid_3")
+	//MOCK_UNSUBSCRIBED为逗号分隔的openid，MOCK_BUSY为逗号分隔的openid:次数
+	for _, openId := range strings.Split(os.Getenv("MOCK_UNSUBSCRIBED"), ",") {
+		if openId != "" {
+			server.Unsubscribe(openId)
+		}
+	}
+	for _, busy := range strings.Split(os.Getenv("MOCK_BUSY"), ",") {
+		parts := strings.SplitN(busy, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if count, err := strconv.Atoi(parts[1]); err == nil {
+			server.FailTemplates(parts[0], count)
+		}
+	}
+	if pageSize, err := strconv.Atoi(os.Getenv("MOCK_PAGE_SIZE")); err == nil && pageSize > 0 {
+		server.SetPageSize(pageSize)
+	}
+	if templateRate, err := strconv.Atoi(os.Getenv("MOCK_TEMPLATE_RATE")); err == nil {
+		server.LimitTemplateRate(templateRate)
+	}
+
+	err := http.ListenAndServe(address, server.Handler())
+	log.WithFields(logrus.Fields{"err": err}).Info("结束模拟微信接口服务")
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"strconv"
+	"sync"
+	"time"
+	"wxGateway/wechat"
+)
+
+//死信状态
+const (
+	DeadLetterStatusParked   = "parked"
+	DeadLetterStatusRedriven = "redriven"
+)
+
+//进入死信的原因，permanent为重试也不会成功的错误，exhausted为重试次数用完
+const (
+	DeadLetterReasonPermanent = "permanent"
+	DeadLetterReasonExhausted = "exhausted"
+)
+
+var deadLettersBucket = []byte("deadLetters")
+
+//发送失败的模板消息，可以查看后重新发送
+type DeadLetter struct {
+	Id         uint64      `json:"id"`
+	Status     string      `json:"status"`
+	Reason     string      `json:"reason"`
+	JobId      string      `json:"jobId"`
+	OpenId     string      `json:"openId"`
+	TemplateId string      `json:"templateId"`
+	Url        string      `json:"url"`
+	Data       interface{} `json:"data"`
+	ErrCode    int         `json:"errcode,omitempty"`
+	ErrMsg     string      `json:"errmsg,omitempty"`
+	CreateTime int64       `json:"createTime"`
+	//重新发送创建的任务
+	RedriveJobId string `json:"redriveJobId,omitempty"`
+	RedriveTime  int64  `json:"redriveTime,omitempty"`
+}
+
+//查询条件，为空的条件不过滤，Before为上一页最后一条的Id
+type DeadLetterQuery struct {
+	Status string `form:"status"`
+	Reason string `form:"reason"`
+	JobId  string `form:"jobId"`
+	OpenId string `form:"openId"`
+	Before uint64 `form:"before"`
+	Limit  int    `form:"limit"`
+}
+
+func (query DeadLetterQuery) match(letter *DeadLetter) bool {
+	return (query.Status == "" || query.Status == letter.Status) &&
+		(query.Reason == "" || query.Reason == letter.Reason) &&
+		(query.JobId == "" || query.JobId == letter.JobId) &&
+		(query.OpenId == "" || query.OpenId == letter.OpenId)
+}
+
+type deadLetterStore struct {
+	db *bolt.DB
+	//防止同一批死信被并发重新发送两次
+	mutex sync.Mutex
+}
+
+var deadLetters *deadLetterStore
+
+func newDeadLetterStore(db *bolt.DB) (*deadLetterStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(deadLettersBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &deadLetterStore{db: db}, nil
+}
+
+//保存发送失败的用户，失败只记录日志
+func (store *deadLetterStore) park(job *Job, openId string, err error) {
+	letter := DeadLetter{
+		Status:     DeadLetterStatusParked,
+		Reason:     DeadLetterReasonPermanent,
+		JobId:      job.Id,
+		OpenId:     openId,
+		TemplateId: job.TemplateId,
+		Url:        job.Url,
+		Data:       job.Data,
+		CreateTime: time.Now().Unix(),
+	}
+	if wechat.IsRetryable(err) {
+		letter.Reason = DeadLetterReasonExhausted
+	}
+	letter.ErrCode, letter.ErrMsg = errorCodeAndMessage(err)
+	storeErr := store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deadLettersBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		letter.Id = id
+		data, err := json.Marshal(letter)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(sequenceKey(id), data)
+	})
+	if storeErr != nil {
+		log.WithFields(logrus.Fields{"letter": letter, "err": storeErr}).Error("保存死信失败")
+	}
+}
+
+func (store *deadLetterStore) get(id uint64) (*DeadLetter, error) {
+	var letter *DeadLetter
+	err := store.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(deadLettersBucket).Get(sequenceKey(id))
+		if data == nil {
+			return errors.New("死信不存在: " + strconv.FormatUint(id, 10))
+		}
+		letter = &DeadLetter{}
+		return json.Unmarshal(data, letter)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return letter, nil
+}
+
+//从新到旧遍历
+func (store *deadLetterStore) query(query DeadLetterQuery) ([]DeadLetter, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultMessageLimit
+	}
+	if query.Limit > maxMessageLimit {
+		query.Limit = maxMessageLimit
+	}
+	letters := make([]DeadLetter, 0, query.Limit)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(deadLettersBucket).Cursor()
+		var key, value []byte
+		if query.Before > 0 {
+			cursor.Seek(sequenceKey(query.Before))
+			key, value = cursor.Prev()
+		} else {
+			key, value = cursor.Last()
+		}
+		for ; key != nil && len(letters) < query.Limit; key, value = cursor.Prev() {
+			var letter DeadLetter
+			err := json.Unmarshal(value, &letter)
+			if err != nil {
+				return err
+			}
+			if query.match(&letter) {
+				letters = append(letters, letter)
+			}
+		}
+		return nil
+	})
+	return letters, err
+}
+
+//重新发送ids中的死信，ids为空时重新发送jobId任务的全部死信
+//同一个任务的死信模板和数据相同，合并为一个新任务，返回创建的任务
+func (store *deadLetterStore) redrive(ids []uint64, jobId string) ([]*Job, error) {
+	if len(ids) == 0 && jobId == "" {
+		return nil, errors.New("重新发送的死信为空")
+	}
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	var letters []DeadLetter
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(deadLettersBucket)
+		if len(ids) == 0 {
+			return bucket.ForEach(func(key, value []byte) error {
+				var letter DeadLetter
+				err := json.Unmarshal(value, &letter)
+				if err == nil && letter.JobId == jobId && letter.Status == DeadLetterStatusParked {
+					letters = append(letters, letter)
+				}
+				return err
+			})
+		}
+		for _, id := range ids {
+			data := bucket.Get(sequenceKey(id))
+			if data == nil {
+				return errors.New("死信不存在: " + strconv.FormatUint(id, 10))
+			}
+			var letter DeadLetter
+			err := json.Unmarshal(data, &letter)
+			if err != nil {
+				return err
+			}
+			if letter.Status != DeadLetterStatusParked {
+				return errors.New("死信已重新发送: " + strconv.FormatUint(id, 10))
+			}
+			letters = append(letters, letter)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(letters) == 0 {
+		return nil, errors.New("没有待重新发送的死信")
+	}
+
+	var groups []string
+	grouped := map[string][]*DeadLetter{}
+	for i := range letters {
+		letter := &letters[i]
+		if _, ok := grouped[letter.JobId]; !ok {
+			groups = append(groups, letter.JobId)
+		}
+		grouped[letter.JobId] = append(grouped[letter.JobId], letter)
+	}
+	started := make([]*Job, 0, len(groups))
+	now := time.Now().Unix()
+	for _, group := range groups {
+		letters := grouped[group]
+		openIds := make([]string, 0, len(letters))
+		seen := map[string]bool{}
+		for _, letter := range letters {
+			if !seen[letter.OpenId] {
+				seen[letter.OpenId] = true
+				openIds = append(openIds, letter.OpenId)
+			}
+		}
+		job := &Job{TemplateId: letters[0].TemplateId, Url: letters[0].Url, Data: letters[0].Data, Target: "redrive:" + group}
+		job = jobs.start(job, func(ctx context.Context) ([]string, error) {
+			return openIds, nil
+		})
+		for _, letter := range letters {
+			letter.Status = DeadLetterStatusRedriven
+			letter.RedriveJobId = job.Id
+			letter.RedriveTime = now
+		}
+		err = store.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(deadLettersBucket)
+			for _, letter := range letters {
+				data, err := json.Marshal(letter)
+				if err != nil {
+					return err
+				}
+				err = bucket.Put(sequenceKey(letter.Id), data)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			log.WithFields(logrus.Fields{"jobId": job.Id, "err": err}).Error("更新死信状态失败")
+		}
+		log.WithFields(logrus.Fields{"jobId": group, "redriveJobId": job.Id, "count": len(openIds)}).Info("重新发送死信")
+		started = append(started, job)
+	}
+	return started, nil
+}
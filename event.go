@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"strconv"
+	"time"
+	"wxGateway/wechat"
+)
+
+//事件处理器，返回的error只记录日志，不影响给微信的回复
+type eventHandler func(ctx context.Context, event wechat.Event) error
+
+//事件类型到处理器的注册表，只在启动时注册
+var eventHandlers = map[string][]eventHandler{}
+
+func registerEventHandler(event string, handler eventHandler) {
+	eventHandlers[event] = append(eventHandlers[event], handler)
+}
+
+//注册内置的和环境变量配置的事件动作
+func initEventHandler() {
+	registerEventHandler(wechat.EventTemplateSendJobFinish, templateSendJobFinishRecorder)
+	registerEventHandler(wechat.EventMassSendJobFinish, massSendJobFinishRecorder)
+	if subscribeTag != "" {
+		registerEventHandler(wechat.EventSubscribe, tagSubscriber)
+	}
+}
+
+//异步执行事件的处理器
+func dispatchEvent(message *wechat.Message) {
+	event, ok := wechat.ParseEvent(message)
+	if !ok {
+		return
+	}
+	handlers := eventHandlers[event.Header().Event]
+	log.WithFields(logrus.Fields{"event": event, "handlers": len(handlers)}).Info("分发微信事件")
+	if len(handlers) == 0 {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+		for i := range handlers {
+			err := handlers[i](ctx, event)
+			if err != nil {
+				log.WithFields(logrus.Fields{"event": event, "err": err}).Error("处理微信事件失败")
+			}
+		}
+	}()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//给新关注的用户打上SUBSCRIBE_TAG配置的标签
+func tagSubscriber(ctx context.Context, event wechat.Event) error {
+	subscribe, ok := event.(wechat.SubscribeEvent)
+	if !ok {
+		return nil
+	}
+	tagId, err := findTagId(ctx, subscribeTag)
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{"openId": subscribe.FromUserName, "tagId": tagId}).Info("给新关注用户加标签")
+	_, err = client.AddTagToUsers(ctx, tagId, []string{subscribe.FromUserName})
+	return err
+}
+
+//在现有标签中按名称或id查找标签
+func findTagId(ctx context.Context, tag string) (int, error) {
+	tags, err := client.ListTags(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for i := range tags {
+		if tags[i].Name == tag || strconv.Itoa(tags[i].Id) == tag {
+			return tags[i].Id, nil
+		}
+	}
+	return 0, errors.New("标签不存在: " + tag)
+}
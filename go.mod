@@ -3,11 +3,13 @@ module wxGateway
 go 1.12
 
 require (
-	github.com/gin-contrib/sessions v0.0.3 // indirect
-	github.com/parnurzeal/gorequest v0.2.16 // indirect
-	github.com/pkg/errors v0.8.1 // indirect
-	github.com/sirupsen/logrus v1.4.2 // indirect
-	github.com/tidwall/gjson v1.3.5 // indirect
-	golang.org/x/net v0.0.0-20191209160850-c0dbc17a3553 // indirect
-	moul.io/http2curl v1.0.0 // indirect
+	github.com/gin-contrib/sessions v0.0.3
+	github.com/gin-gonic/gin v1.5.0
+	github.com/gomodule/redigo v2.0.0+incompatible
+	github.com/robfig/cron/v3 v3.0.1
+	github.com/sirupsen/logrus v1.4.2
+	github.com/tidwall/gjson v1.3.5
+	go.etcd.io/bbolt v1.3.5
+	golang.org/x/sys v0.7.0 // indirect
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
 )
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//同一个幂等键在这段时间内只发送一次
+var idempotencyWindow = 24 * time.Hour
+
+const idempotencyKeyHeader = "Idempotency-Key"
+const idempotencyKeyField = "idempotencyKey"
+const maxIdempotencyKeyLength = 255
+
+var idempotencyBucket = []byte("idempotency")
+
+//第一次请求成功时的响应，重复请求原样返回
+type idempotentResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+	CreateTime  int64  `json:"createTime"`
+}
+
+type idempotencyStore struct {
+	db     *bolt.DB
+	window time.Duration
+	mutex  sync.Mutex
+	//正在处理的幂等键，相同键的请求等它结束
+	pending map[string]chan struct{}
+	sweepAt time.Time
+}
+
+var idempotency *idempotencyStore
+
+func newIdempotencyStore(db *bolt.DB, window time.Duration) (*idempotencyStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(idempotencyBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &idempotencyStore{db: db, window: window, pending: map[string]chan struct{}{}}, nil
+}
+
+func (store *idempotencyStore) load(key string) (*idempotentResponse, error) {
+	var response *idempotentResponse
+	err := store.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(idempotencyBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		response = &idempotentResponse{}
+		return json.Unmarshal(data, response)
+	})
+	if err != nil || response == nil {
+		return nil, err
+	}
+	if time.Since(time.Unix(response.CreateTime, 0)) > store.window {
+		return nil, nil
+	}
+	return response, nil
+}
+
+//返回已保存的响应，没有时占用这个键，调用方处理完后必须调用finish
+func (store *idempotencyStore) begin(key string) (*idempotentResponse, error) {
+	store.mutex.Lock()
+	for {
+		wait, ok := store.pending[key]
+		if !ok {
+			break
+		}
+		store.mutex.Unlock()
+		<-wait
+		store.mutex.Lock()
+	}
+	defer store.mutex.Unlock()
+	response, err := store.load(key)
+	if err != nil || response != nil {
+		return response, err
+	}
+	store.pending[key] = make(chan struct{})
+	return nil, nil
+}
+
+//保存响应并释放这个键，response为nil时只释放，之后的请求会重新发送
+func (store *idempotencyStore) finish(key string, response *idempotentResponse) {
+	var err error
+	store.mutex.Lock()
+	if response != nil {
+		err = store.save(key, response)
+	}
+	close(store.pending[key])
+	delete(store.pending, key)
+	store.mutex.Unlock()
+	if err != nil {
+		log.WithFields(logrus.Fields{"key": key, "err": err}).Error("保存幂等响应失败")
+	}
+}
+
+//保存时顺便清理过期的键，每个window最多清理一次
+func (store *idempotencyStore) save(key string, response *idempotentResponse) error {
+	data, err := json.Marshal(response)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	sweep := now.After(store.sweepAt)
+	if sweep {
+		store.sweepAt = now.Add(store.window)
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(idempotencyBucket)
+		if sweep {
+			expireAt := now.Add(-store.window).Unix()
+			var expiredKeys [][]byte
+			bucket.ForEach(func(key, value []byte) error {
+				if gjson.GetBytes(value, "createTime").Int() < expireAt {
+					expiredKeys = append(expiredKeys, append([]byte(nil), key...))
+				}
+				return nil
+			})
+			for _, expiredKey := range expiredKeys {
+				bucket.Delete(expiredKey)
+			}
+		}
+		return bucket.Put([]byte(key), data)
+	})
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//记录响应内容的ResponseWriter
+type idempotentWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (writer *idempotentWriter) Write(data []byte) (int, error) {
+	writer.body.Write(data)
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *idempotentWriter) WriteString(data string) (int, error) {
+	writer.body.WriteString(data)
+	return writer.ResponseWriter.WriteString(data)
+}
+
+//发送接口的幂等中间件，幂等键取Idempotency-Key请求头，或者表单、json中的idempotencyKey字段
+//只保存code为1的响应，发送失败时重试会重新发送
+func idempotent(context *gin.Context) {
+	idempotencyKey, err := readIdempotencyKey(context)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("幂等键非法")
+		context.Abort()
+		context.JSON(http.StatusOK, createResponseData(nil, err))
+		return
+	}
+	if idempotencyKey == "" {
+		context.Next()
+		return
+	}
+	key := context.Request.URL.Path + " " + idempotencyKey
+	response, err := idempotency.begin(key)
+	if err != nil {
+		log.WithFields(logrus.Fields{"key": key, "err": err}).Error("读取幂等响应失败")
+		context.Abort()
+		context.JSON(http.StatusOK, createResponseData(nil, err))
+		return
+	}
+	if response != nil {
+		log.WithFields(logrus.Fields{"key": key}).Info("重复请求，返回第一次的响应")
+		context.Abort()
+		context.Header("Idempotent-Replayed", "true")
+		context.Data(response.Status, response.ContentType, response.Body)
+		return
+	}
+	writer := &idempotentWriter{ResponseWriter: context.Writer}
+	context.Writer = writer
+	defer func() {
+		if writer.Status() != http.StatusOK || gjson.GetBytes(writer.body.Bytes(), "code").Int() != 1 {
+			idempotency.finish(key, nil)
+			return
+		}
+		idempotency.finish(key, &idempotentResponse{
+			Status:      writer.Status(),
+			ContentType: writer.Header().Get("Content-Type"),
+			Body:        writer.body.Bytes(),
+			CreateTime:  time.Now().Unix(),
+		})
+	}()
+	context.Next()
+}
+
+func readIdempotencyKey(context *gin.Context) (string, error) {
+	idempotencyKey := context.GetHeader(idempotencyKeyHeader)
+	if idempotencyKey == "" {
+		//有的调用方发json时不设置Content-Type，按内容判断，读完后放回请求体
+		data, err := ioutil.ReadAll(context.Request.Body)
+		if err != nil {
+			return "", err
+		}
+		context.Request.Body = ioutil.NopCloser(bytes.NewReader(data))
+		if gjson.ValidBytes(data) {
+			idempotencyKey = gjson.GetBytes(data, idempotencyKeyField).String()
+		} else {
+			idempotencyKey = context.PostForm(idempotencyKeyField)
+		}
+	}
+	if len(idempotencyKey) > maxIdempotencyKeyLength {
+		return "", errors.New("幂等键过长")
+	}
+	return idempotencyKey, nil
+}
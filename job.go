@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"wxGateway/wechat"
+)
+
+//任务状态
+const (
+	JobStatusPending  = "pending"
+	JobStatusRunning  = "running"
+	JobStatusDone     = "done"
+	JobStatusFailed   = "failed"
+	JobStatusCanceled = "canceled"
+)
+
+//任务中每个用户的发送状态
+const (
+	RecipientStatusPending  = "pending"
+	RecipientStatusSent     = "sent"
+	RecipientStatusFailed   = "failed"
+	RecipientStatusCanceled = "canceled"
+)
+
+//已结束的任务保留的时间
+var jobRetention = 24 * time.Hour
+
+//批量发送模板消息的后台任务
+type Job struct {
+	Id         string      `json:"id"`
+	Status     string      `json:"status"`
+	TemplateId string      `json:"templateId"`
+	Url        string      `json:"url"`
+	Data       interface{} `json:"data"`
+	//收件人的描述，比如tag:100
+	Target string `json:"target"`
+	//由定时发送创建时为定时发送的id
+	ScheduleId string `json:"scheduleId,omitempty"`
+	CreateTime int64  `json:"createTime"`
+	FinishTime int64  `json:"finishTime,omitempty"`
+	//获取收件人失败等导致整个任务失败的原因
+	Error      string          `json:"error,omitempty"`
+	Summary    JobSummary      `json:"summary"`
+	Recipients []*JobRecipient `json:"recipients,omitempty"`
+
+	mutex    sync.Mutex
+	cancel   context.CancelFunc
+	canceled bool
+}
+
+type JobSummary struct {
+	Total    int `json:"total"`
+	Pending  int `json:"pending"`
+	Sent     int `json:"sent"`
+	Failed   int `json:"failed"`
+	Canceled int `json:"canceled"`
+	//已发送的用户中，收到发送结果事件的送达和未送达数
+	Delivered   int `json:"delivered"`
+	Undelivered int `json:"undelivered"`
+}
+
+type JobRecipient struct {
+	OpenId  string `json:"openId"`
+	Status  string `json:"status"`
+	MsgId   int64  `json:"msgId,omitempty"`
+	ErrCode int    `json:"errcode,omitempty"`
+	ErrMsg  string `json:"errmsg,omitempty"`
+	//TEMPLATESENDJOBFINISH推送的送达结果
+	Delivery string `json:"delivery,omitempty"`
+}
+
+//任务的只读副本，可以安全地序列化
+func (job *Job) snapshot() *Job {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	copied := &Job{
+		Id:         job.Id,
+		Status:     job.Status,
+		TemplateId: job.TemplateId,
+		Url:        job.Url,
+		Data:       job.Data,
+		Target:     job.Target,
+		ScheduleId: job.ScheduleId,
+		CreateTime: job.CreateTime,
+		FinishTime: job.FinishTime,
+		Error:      job.Error,
+		Summary:    job.Summary,
+		Recipients: make([]*JobRecipient, len(job.Recipients)),
+	}
+	for i := range job.Recipients {
+		recipient := *job.Recipients[i]
+		copied.Recipients[i] = &recipient
+	}
+	return copied
+}
+
+func (job *Job) isFinished() bool {
+	return job.Status == JobStatusDone || job.Status == JobStatusFailed || job.Status == JobStatusCanceled
+}
+
+func (job *Job) setRecipients(openIds []string) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.Recipients = make([]*JobRecipient, len(openIds))
+	for i := range openIds {
+		job.Recipients[i] = &JobRecipient{OpenId: openIds[i], Status: RecipientStatusPending}
+	}
+	job.Summary = JobSummary{Total: len(openIds), Pending: len(openIds)}
+	job.Status = JobStatusRunning
+}
+
+//记录一个用户的发送结果
+func (job *Job) finishRecipient(recipient *JobRecipient, msgId int64, err error) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	job.Summary.Pending--
+	if err == nil {
+		recipient.Status = RecipientStatusSent
+		recipient.MsgId = msgId
+		job.Summary.Sent++
+		return
+	}
+	recipient.Status = RecipientStatusFailed
+	recipient.ErrCode, recipient.ErrMsg = errorCodeAndMessage(err)
+	job.Summary.Failed++
+}
+
+//结束任务，取消时还没发送的用户标记为canceled
+func (job *Job) finish(err error) {
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	canceled := false
+	for i := range job.Recipients {
+		if job.Recipients[i].Status == RecipientStatusPending {
+			job.Recipients[i].Status = RecipientStatusCanceled
+			job.Summary.Pending--
+			job.Summary.Canceled++
+			canceled = true
+		}
+	}
+	switch {
+	case job.canceled || canceled:
+		job.Status = JobStatusCanceled
+	case err != nil:
+		job.Status = JobStatusFailed
+		job.Error = err.Error()
+	default:
+		job.Status = JobStatusDone
+	}
+	job.FinishTime = time.Now().Unix()
+	job.cancel()
+}
+
+//模板消息的收件人，三种来源可以同时使用，发送前合并去重
+type JobRecipients struct {
+	OpenIds []string `json:"openIds,omitempty"`
+	TagIds  []int    `json:"tagIds,omitempty"`
+	//发给全部关注用户
+	All bool `json:"all,omitempty"`
+}
+
+func (recipients JobRecipients) validate() error {
+	if len(recipients.OpenIds) == 0 && len(recipients.TagIds) == 0 && !recipients.All {
+		return errors.New("收件人为空")
+	}
+	for _, tagId := range recipients.TagIds {
+		if tagId <= 0 {
+			return errors.New("tagId非法: " + strconv.Itoa(tagId))
+		}
+	}
+	return nil
+}
+
+//收件人的描述，比如all,tag:100,openid:3
+func (recipients JobRecipients) target() string {
+	var targets []string
+	if recipients.All {
+		targets = append(targets, "all")
+	}
+	for _, tagId := range recipients.TagIds {
+		targets = append(targets, "tag:"+strconv.Itoa(tagId))
+	}
+	if len(recipients.OpenIds) > 0 {
+		targets = append(targets, "openid:"+strconv.Itoa(len(recipients.OpenIds)))
+	}
+	return strings.Join(targets, ",")
+}
+
+//获取全部收件人的openid，按出现的顺序去重
+func (recipients JobRecipients) list(ctx context.Context) ([]string, error) {
+	var openIds []string
+	seen := map[string]bool{}
+	add := func(list []string) {
+		for _, openId := range list {
+			if openId != "" && !seen[openId] {
+				seen[openId] = true
+				openIds = append(openIds, openId)
+			}
+		}
+	}
+	add(recipients.OpenIds)
+	for _, tagId := range recipients.TagIds {
+		list, err := client.ListOpenIdsByTag(ctx, tagId)
+		if err != nil {
+			return nil, err
+		}
+		add(list)
+	}
+	if recipients.All {
+		list, err := client.ListOpenIds(ctx)
+		if err != nil {
+			return nil, err
+		}
+		add(list)
+	}
+	return openIds, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+type jobManager struct {
+	mutex sync.Mutex
+	jobs  map[string]*Job
+}
+
+var jobs = &jobManager{jobs: map[string]*Job{}}
+
+func newJobId() string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+//创建任务并在后台执行，listOpenIds获取收件人
+func (manager *jobManager) start(job *Job, listOpenIds func(ctx context.Context) ([]string, error)) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	job.Id = newJobId()
+	job.Status = JobStatusPending
+	job.CreateTime = time.Now().Unix()
+	job.cancel = cancel
+
+	manager.mutex.Lock()
+	manager.removeExpired()
+	manager.jobs[job.Id] = job
+	manager.mutex.Unlock()
+
+	log.WithFields(logrus.Fields{"id": job.Id, "templateId": job.TemplateId, "target": job.Target}).Info("创建发送模板消息任务")
+	go runJob(ctx, job, listOpenIds)
+	return job.snapshot()
+}
+
+func (manager *jobManager) removeExpired() {
+	expireAt := time.Now().Add(-jobRetention).Unix()
+	for id, job := range manager.jobs {
+		job.mutex.Lock()
+		expired := job.isFinished() && job.FinishTime < expireAt
+		job.mutex.Unlock()
+		if expired {
+			delete(manager.jobs, id)
+		}
+	}
+}
+
+func (manager *jobManager) get(id string) (*Job, error) {
+	manager.mutex.Lock()
+	job, ok := manager.jobs[id]
+	manager.mutex.Unlock()
+	if !ok {
+		return nil, errors.New("任务不存在: " + id)
+	}
+	return job.snapshot(), nil
+}
+
+//按创建时间倒序，不带收件人明细
+func (manager *jobManager) list() []*Job {
+	manager.mutex.Lock()
+	list := make([]*Job, 0, len(manager.jobs))
+	for _, job := range manager.jobs {
+		list = append(list, job)
+	}
+	manager.mutex.Unlock()
+	for i := range list {
+		list[i] = list[i].snapshot()
+		list[i].Recipients = nil
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreateTime > list[j].CreateTime
+	})
+	return list
+}
+
+//取消任务，正在发送的那条消息会发完
+func (manager *jobManager) cancel(id string) (*Job, error) {
+	manager.mutex.Lock()
+	job, ok := manager.jobs[id]
+	manager.mutex.Unlock()
+	if !ok {
+		return nil, errors.New("任务不存在: " + id)
+	}
+	job.mutex.Lock()
+	if job.isFinished() {
+		job.mutex.Unlock()
+		return nil, errors.New("任务已结束: " + id)
+	}
+	job.canceled = true
+	job.mutex.Unlock()
+	job.cancel()
+	log.WithFields(logrus.Fields{"id": id}).Info("取消发送模板消息任务")
+	return job.snapshot(), nil
+}
+
+//记录任务中msgId那条消息的送达结果，任务已过期时忽略
+func (manager *jobManager) deliver(id string, msgId int64, delivery string) {
+	manager.mutex.Lock()
+	job, ok := manager.jobs[id]
+	manager.mutex.Unlock()
+	if !ok {
+		return
+	}
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	for _, recipient := range job.Recipients {
+		if recipient.MsgId != msgId || recipient.Delivery != "" {
+			continue
+		}
+		recipient.Delivery = delivery
+		if delivery == wechat.TemplateSendStatusSuccess {
+			job.Summary.Delivered++
+		} else {
+			job.Summary.Undelivered++
+		}
+		return
+	}
+}
+
+//获取收件人后并发发送，任务被取消后剩下的用户不再发送
+func runJob(ctx context.Context, job *Job, listOpenIds func(ctx context.Context) ([]string, error)) {
+	openIds, err := listOpenIds(ctx)
+	if err != nil {
+		log.WithFields(logrus.Fields{"id": job.Id, "err": err}).Error("获取任务收件人失败")
+		job.finish(err)
+		return
+	}
+	job.setRecipients(openIds)
+	sendJobRecipients(ctx, job)
+	job.finish(nil)
+	summary := job.snapshot().Summary
+	log.WithFields(logrus.Fields{"id": job.Id, "summary": summary}).Info("发送模板消息任务结束")
+}
@@ -1,22 +1,26 @@
 package main
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
 	"github.com/gin-gonic/gin"
-	"github.com/parnurzeal/gorequest"
 	"github.com/sirupsen/logrus"
-	"github.com/tidwall/gjson"
+	bolt "go.etcd.io/bbolt"
 	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+	"wxGateway/wechat"
 )
 
 var address = ":8990"
+var apiUrl = wechat.DefaultApiUrl
 var log = logrus.New()
 
 var timeout = 5 * time.Second
@@ -25,41 +29,111 @@ var secretKey = "secret"
 var secret = strconv.FormatFloat(rand.Float64(), 'E', -1, 64)
 
 var token string
+var callbackToken string
+var encodingAesKey string
+var subscribeTag string
+var msgCrypt *wechat.MsgCrypt
 var appId string
 var appSecret string
-var accessToken string
-
-type Template struct {
-	TemplateId string `json:"template_id"`
-	Title      string `json:"title"`
-}
-
-type Tag struct {
-	Id    int    `json:"id"`
-	Name  string `json:"name"`
-	Count int    `json:"count"`
-}
-
-type UserInfo struct {
-	OpenId    string `json:"openid"`
-	Nickname  string `json:"nickname"`
-	TagIdList []int  `json:"tagid_list"`
-}
-
-func init() {
+var tokenMode string
+var tokenProviderUrl string
+var tokenProviderToken string
+var tokenStore string
+var tokenStorePath = "accessToken.json"
+var redisAddress string
+var redisPassword string
+var webhooksString string
+var webhooks []Webhook
+var ruleFile = "rules.json"
+var dbPath = "wxGateway.db"
+var db *bolt.DB
+var client *wechat.Client
+
+//读取配置并初始化存储和客户端，放在main中调用，测试不需要环境变量
+func initConfig() {
 	readConfig()
 	if appId == "" {
 		log.Error("公众号appId为空")
 		os.Exit(0)
 	}
-	if appSecret == "" {
+	if tokenMode != "" && tokenMode != wechat.TokenModeCredential && tokenMode != wechat.TokenModeShared && tokenMode != wechat.TokenModeStable {
+		log.WithFields(logrus.Fields{"tokenMode": tokenMode}).Error("accessToken获取方式非法")
+		os.Exit(0)
+	}
+	if tokenMode == wechat.TokenModeShared {
+		if tokenProviderUrl == "" {
+			log.Error("共享accessToken的网关地址为空")
+			os.Exit(0)
+		}
+	} else if appSecret == "" {
 		log.Error("公众号appSecret为空")
 		os.Exit(0)
 	}
+	if encodingAesKey != "" {
+		var err error
+		msgCrypt, err = wechat.NewMsgCrypt(callbackToken, encodingAesKey, appId)
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("消息加解密密钥非法")
+			os.Exit(0)
+		}
+	}
+	var err error
+	webhooks, err = parseWebhooks(webhooksString)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("webhook配置非法")
+		os.Exit(0)
+	}
+	rules = newRuleManager(ruleFile)
+	db, err = bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.WithFields(logrus.Fields{"dbPath": dbPath, "err": err}).Error("打开数据库失败")
+		os.Exit(0)
+	}
+	messages, err = newMessageStore(db)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("初始化消息记录失败")
+		os.Exit(0)
+	}
+	idempotency, err = newIdempotencyStore(db, idempotencyWindow)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("初始化幂等存储失败")
+		os.Exit(0)
+	}
+	deadLetters, err = newDeadLetterStore(db)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("初始化死信队列失败")
+		os.Exit(0)
+	}
+	massRecords, err = newMassRecordStore(db)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("初始化群发记录失败")
+		os.Exit(0)
+	}
+	schedules, err = newScheduleStore(db)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("加载定时发送失败")
+		os.Exit(0)
+	}
+	throttle = newSendThrottle(sendRatePerMinute)
+	client = wechat.NewClient(wechat.Config{
+		AppId:              appId,
+		AppSecret:          appSecret,
+		ApiUrl:             apiUrl,
+		Timeout:            timeout,
+		Retry:              retry,
+		Logger:             log,
+		TokenMode:          tokenMode,
+		TokenProviderUrl:   tokenProviderUrl,
+		TokenProviderToken: tokenProviderToken,
+		TokenStore:         createTokenStore(),
+	})
 }
 
 func main() {
-	go autoFlushAccessToken()
+	initConfig()
+	go client.AutoFlushAccessToken(context.Background())
+	go schedules.run(context.Background())
+	initEventHandler()
 	startWebService()
 }
 
@@ -72,9 +146,80 @@ func readConfig() error {
 	log.WithFields(logrus.Fields{"appSecret": len(appSecret)}).Infof("环境变量配置公众号appSecret长度")
 	token = os.Getenv("TOKEN")
 	log.WithFields(logrus.Fields{"token": len(token)}).Infof("环境变量配置token长度")
+	callbackToken = os.Getenv("CALLBACK_TOKEN")
+	if callbackToken == "" {
+		callbackToken = token
+	}
+	log.WithFields(logrus.Fields{"callbackToken": len(callbackToken)}).Infof("环境变量配置微信服务器token长度")
+	encodingAesKey = os.Getenv("ENCODING_AES_KEY")
+	log.WithFields(logrus.Fields{"encodingAesKey": len(encodingAesKey)}).Infof("环境变量配置消息加解密密钥长度")
+	subscribeTag = os.Getenv("SUBSCRIBE_TAG")
+	log.WithFields(logrus.Fields{"subscribeTag": subscribeTag}).Infof("环境变量配置新关注用户的标签")
+	if url := os.Getenv("API_URL"); url != "" {
+		apiUrl = url
+	}
+	log.WithFields(logrus.Fields{"apiUrl": apiUrl}).Infof("微信接口地址")
+	tokenMode = os.Getenv("TOKEN_MODE")
+	log.WithFields(logrus.Fields{"tokenMode": tokenMode}).Infof("环境变量配置accessToken获取方式")
+	tokenProviderUrl = os.Getenv("TOKEN_PROVIDER_URL")
+	log.WithFields(logrus.Fields{"tokenProviderUrl": tokenProviderUrl}).Infof("环境变量配置共享accessToken的网关地址")
+	tokenProviderToken = os.Getenv("TOKEN_PROVIDER_TOKEN")
+	log.WithFields(logrus.Fields{"tokenProviderToken": len(tokenProviderToken)}).Infof("环境变量配置共享accessToken的网关token长度")
+	tokenStore = os.Getenv("TOKEN_STORE")
+	log.WithFields(logrus.Fields{"tokenStore": tokenStore}).Infof("环境变量配置accessToken存储")
+	if path := os.Getenv("TOKEN_STORE_PATH"); path != "" {
+		tokenStorePath = path
+	}
+	log.WithFields(logrus.Fields{"tokenStorePath": tokenStorePath}).Infof("accessToken文件存储路径")
+	redisAddress = os.Getenv("REDIS_ADDRESS")
+	log.WithFields(logrus.Fields{"redisAddress": redisAddress}).Infof("环境变量配置redis地址")
+	redisPassword = os.Getenv("REDIS_PASSWORD")
+	log.WithFields(logrus.Fields{"redisPassword": len(redisPassword)}).Infof("环境变量配置redis密码长度")
+	webhooksString = os.Getenv("WEBHOOKS")
+	log.WithFields(logrus.Fields{"webhooks": len(webhooksString)}).Infof("环境变量配置webhook长度")
+	if concurrency, err := strconv.Atoi(os.Getenv("SEND_CONCURRENCY")); err == nil && concurrency > 0 {
+		sendConcurrency = concurrency
+	}
+	log.WithFields(logrus.Fields{"sendConcurrency": sendConcurrency}).Infof("发送模板消息的并发数")
+	if ratePerMinute, err := strconv.Atoi(os.Getenv("SEND_RATE_PER_MINUTE")); err == nil && ratePerMinute > 0 {
+		sendRatePerMinute = ratePerMinute
+	}
+	log.WithFields(logrus.Fields{"sendRatePerMinute": sendRatePerMinute}).Infof("每分钟发送模板消息的上限")
+	if path := os.Getenv("RULE_FILE"); path != "" {
+		ruleFile = path
+	}
+	log.WithFields(logrus.Fields{"ruleFile": ruleFile}).Infof("自动回复规则文件路径")
+	if path := os.Getenv("DB_PATH"); path != "" {
+		dbPath = path
+	}
+	log.WithFields(logrus.Fields{"dbPath": dbPath}).Infof("数据库文件路径")
+	if window, err := time.ParseDuration(os.Getenv("IDEMPOTENCY_WINDOW")); err == nil && window > 0 {
+		idempotencyWindow = window
+	}
+	log.WithFields(logrus.Fields{"idempotencyWindow": idempotencyWindow}).Infof("幂等键有效时间")
 	return nil
 }
 
+//多副本部署时用file或redis存储共享accessToken
+func createTokenStore() wechat.TokenStore {
+	switch tokenStore {
+	case "", "memory":
+		return nil
+	case "file":
+		return wechat.NewFileTokenStore(tokenStorePath)
+	case "redis":
+		if redisAddress == "" {
+			log.Error("redis地址为空")
+			os.Exit(0)
+		}
+		return wechat.NewRedisTokenStore(redisAddress, redisPassword, "wxGateway:accessToken:"+appId)
+	default:
+		log.WithFields(logrus.Fields{"tokenStore": tokenStore}).Error("accessToken存储非法")
+		os.Exit(0)
+		return nil
+	}
+}
+
 //----------------------------------------------------------------------------------------------------------------------
 
 func startWebService() {
@@ -89,13 +234,134 @@ func startWebService() {
 		context.String(200, indexHtmlString)
 	})
 	engine.GET("/listAllTemplate", validate, func(context *gin.Context) {
-		context.JSON(http.StatusOK, createResponseData(listAllTemplate()))
+		context.JSON(http.StatusOK, createResponseData(client.ListTemplates(context.Request.Context())))
 	})
 	engine.GET("/listAllTag", validate, func(context *gin.Context) {
-		context.JSON(http.StatusOK, createResponseData(listAllTag()))
+		context.JSON(http.StatusOK, createResponseData(client.ListTags(context.Request.Context())))
 	})
 	engine.GET("/listAllUserInfo", validate, func(context *gin.Context) {
-		context.JSON(http.StatusOK, createResponseData(listAllUserInfo()))
+		context.JSON(http.StatusOK, createResponseData(client.ListAllUserInfos(context.Request.Context())))
+	})
+	engine.GET("/listAllRule", validate, func(context *gin.Context) {
+		context.JSON(http.StatusOK, createResponseData(rules.list()))
+	})
+	engine.GET("/api/accessToken", validateApi, func(context *gin.Context) {
+		stale := context.Query("stale")
+		log.WithFields(logrus.Fields{"stale": len(stale)}).Info("获取accessToken")
+		context.JSON(http.StatusOK, createResponseData(getAccessToken(context.Request.Context(), stale)))
+	})
+
+	engine.POST("/api/customMessage", validateApi, idempotent, func(context *gin.Context) {
+		var message wechat.CustomMessage
+		err := context.ShouldBindJSON(&message)
+		log.WithFields(logrus.Fields{"message": message}).Info("customMessage请求参数")
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("反序列化客服消息失败")
+			context.JSON(http.StatusOK, createResponseData(nil, err))
+			return
+		}
+		context.JSON(http.StatusOK, createResponseData(nil, sendCustomMessage(context.Request.Context(), message)))
+	})
+	engine.POST("/api/customTyping", validateApi, func(context *gin.Context) {
+		var request struct {
+			ToUser  string `json:"touser"`
+			Command string `json:"command"`
+		}
+		err := context.ShouldBindJSON(&request)
+		log.WithFields(logrus.Fields{"request": request}).Info("customTyping请求参数")
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("反序列化客服输入状态失败")
+			context.JSON(http.StatusOK, createResponseData(nil, err))
+			return
+		}
+		context.JSON(http.StatusOK, createResponseData(nil, client.SendTyping(context.Request.Context(), request.ToUser, request.Command)))
+	})
+
+	engine.GET("/api/jobs", validateApi, func(context *gin.Context) {
+		context.JSON(http.StatusOK, createResponseData(jobs.list(), nil))
+	})
+	engine.GET("/api/jobs/:id", validateApi, func(context *gin.Context) {
+		id := context.Param("id")
+		log.WithFields(logrus.Fields{"id": id}).Info("查询任务")
+		context.JSON(http.StatusOK, createResponseData(jobs.get(id)))
+	})
+	engine.POST("/api/jobs/:id/cancel", validateApi, func(context *gin.Context) {
+		id := context.Param("id")
+		log.WithFields(logrus.Fields{"id": id}).Info("取消任务")
+		context.JSON(http.StatusOK, createResponseData(jobs.cancel(id)))
+	})
+
+	engine.POST("/api/schedules", validateApi, idempotent, func(context *gin.Context) {
+		var schedule Schedule
+		err := context.ShouldBindJSON(&schedule)
+		log.WithFields(logrus.Fields{"schedule": schedule}).Info("定时发送请求参数")
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("反序列化定时发送失败")
+			context.JSON(http.StatusOK, createResponseData(nil, err))
+			return
+		}
+		context.JSON(http.StatusOK, createResponseData(schedules.add(schedule)))
+	})
+	engine.GET("/api/schedules", validateApi, func(context *gin.Context) {
+		context.JSON(http.StatusOK, createResponseData(schedules.list(), nil))
+	})
+	engine.GET("/api/schedules/:id", validateApi, func(context *gin.Context) {
+		id := context.Param("id")
+		log.WithFields(logrus.Fields{"id": id}).Info("查询定时发送")
+		context.JSON(http.StatusOK, createResponseData(schedules.get(id)))
+	})
+	engine.POST("/api/schedules/:id/cancel", validateApi, func(context *gin.Context) {
+		id := context.Param("id")
+		log.WithFields(logrus.Fields{"id": id}).Info("取消定时发送")
+		context.JSON(http.StatusOK, createResponseData(schedules.cancel(id)))
+	})
+	engine.GET("/api/messages", validateApi, func(context *gin.Context) {
+		var query MessageQuery
+		err := context.ShouldBindQuery(&query)
+		log.WithFields(logrus.Fields{"query": query}).Info("查询消息记录")
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("消息记录查询参数非法")
+			context.JSON(http.StatusOK, createResponseData(nil, err))
+			return
+		}
+		context.JSON(http.StatusOK, createResponseData(messages.query(query)))
+	})
+
+	engine.GET("/api/deadLetters", validateApi, func(context *gin.Context) {
+		var query DeadLetterQuery
+		err := context.ShouldBindQuery(&query)
+		log.WithFields(logrus.Fields{"query": query}).Info("查询死信")
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("死信查询参数非法")
+			context.JSON(http.StatusOK, createResponseData(nil, err))
+			return
+		}
+		context.JSON(http.StatusOK, createResponseData(deadLetters.query(query)))
+	})
+	engine.GET("/api/deadLetters/:id", validateApi, func(context *gin.Context) {
+		idString := context.Param("id")
+		log.WithFields(logrus.Fields{"id": idString}).Info("查询死信")
+		id, err := strconv.ParseUint(idString, 10, 64)
+		if err != nil {
+			log.Error("死信id参数非法")
+			context.JSON(http.StatusOK, createResponseData(nil, err))
+			return
+		}
+		context.JSON(http.StatusOK, createResponseData(deadLetters.get(id)))
+	})
+	engine.POST("/api/deadLetters/redrive", validateApi, idempotent, func(context *gin.Context) {
+		var request struct {
+			Ids   []uint64 `json:"ids"`
+			JobId string   `json:"jobId"`
+		}
+		err := context.ShouldBindJSON(&request)
+		log.WithFields(logrus.Fields{"request": request}).Info("重新发送死信请求参数")
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("反序列化重新发送死信请求失败")
+			context.JSON(http.StatusOK, createResponseData(nil, err))
+			return
+		}
+		context.JSON(http.StatusOK, createResponseData(deadLetters.redrive(request.Ids, request.JobId)))
 	})
 
 	engine.POST("/login", func(context *gin.Context) {
@@ -112,7 +378,7 @@ func startWebService() {
 	engine.POST("/createTag", validate, func(context *gin.Context) {
 		tag := context.PostForm("tag")
 		log.WithFields(logrus.Fields{"tag": tag}).Info("createTag表单参数")
-		context.JSON(http.StatusOK, createResponseData(createTag(tag)))
+		context.JSON(http.StatusOK, createResponseData(client.CreateTag(context.Request.Context(), tag)))
 	})
 	engine.POST("/deleteTag", validate, func(context *gin.Context) {
 		tagIdString := context.PostForm("tagId")
@@ -123,7 +389,7 @@ func startWebService() {
 			context.JSON(http.StatusOK, createResponseData(nil, err))
 			return
 		}
-		context.JSON(http.StatusOK, createResponseData(deleteTag(tagId)))
+		context.JSON(http.StatusOK, createResponseData(client.DeleteTag(context.Request.Context(), tagId)))
 	})
 	engine.POST("/addTagToUser", validate, func(context *gin.Context) {
 		tagIdString := context.PostForm("tagId")
@@ -135,7 +401,7 @@ func startWebService() {
 			context.JSON(http.StatusOK, createResponseData(nil, err))
 			return
 		}
-		context.JSON(http.StatusOK, createResponseData(addTagToUser(tagId, []string{openIdString})))
+		context.JSON(http.StatusOK, createResponseData(client.AddTagToUsers(context.Request.Context(), tagId, []string{openIdString})))
 	})
 	engine.POST("/deleteTagFromUser", validate, func(context *gin.Context) {
 		tagIdString := context.PostForm("tagId")
@@ -147,9 +413,48 @@ func startWebService() {
 			context.JSON(http.StatusOK, createResponseData(nil, err))
 			return
 		}
-		context.JSON(http.StatusOK, createResponseData(deleteTagFromUser(tagId, []string{openIdString})))
+		context.JSON(http.StatusOK, createResponseData(client.DeleteTagFromUsers(context.Request.Context(), tagId, []string{openIdString})))
+	})
+	engine.POST("/saveRule", validate, func(context *gin.Context) {
+		ruleString := context.PostForm("rule")
+		log.WithFields(logrus.Fields{"rule": ruleString}).Info("saveRule表单参数")
+		var rule Rule
+		err := json.Unmarshal([]byte(ruleString), &rule)
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("反序列化rule失败")
+			context.JSON(http.StatusOK, createResponseData(nil, err))
+			return
+		}
+		context.JSON(http.StatusOK, createResponseData(rules.saveRule(rule)))
+	})
+	engine.POST("/deleteRule", validate, func(context *gin.Context) {
+		id := context.PostForm("id")
+		log.WithFields(logrus.Fields{"id": id}).Info("deleteRule表单参数")
+		context.JSON(http.StatusOK, createResponseData(rules.deleteRule(id)))
 	})
-	engine.POST("/sendTemplateToTag", func(context *gin.Context) {
+	engine.POST("/api/sendTemplate", validateApi, idempotent, func(context *gin.Context) {
+		var request struct {
+			TemplateId string            `json:"templateId"`
+			Url        string            `json:"url"`
+			Data       map[string]string `json:"data"`
+			JobRecipients
+		}
+		err := context.ShouldBindJSON(&request)
+		log.WithFields(logrus.Fields{"request": request}).Info("sendTemplate请求参数")
+		if err == nil && request.TemplateId == "" {
+			err = errors.New("templateId为空")
+		}
+		if err == nil {
+			err = request.JobRecipients.validate()
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("sendTemplate请求参数非法")
+			context.JSON(http.StatusOK, createResponseData(nil, err))
+			return
+		}
+		context.JSON(http.StatusOK, createResponseData(sendTemplate(request.TemplateId, request.Url, request.Data, request.JobRecipients), nil))
+	})
+	engine.POST("/sendTemplateToTag", validateApi, idempotent, func(context *gin.Context) {
 		templateId := context.PostForm("templateId")
 		tagIdString := context.PostForm("tagId")
 		url := context.PostForm("url")
@@ -165,12 +470,14 @@ func startWebService() {
 		err = json.Unmarshal([]byte(dataString), &data)
 		if err == nil {
 			log.WithFields(logrus.Fields{"data": data}).Info("反序列化data成功")
-			context.JSON(http.StatusOK, createResponseData(sendTemplateToTag(templateId, tagId, url, data)))
+			context.JSON(http.StatusOK, createResponseData(sendTemplateToTag(templateId, tagId, url, data), nil))
 		} else {
 			log.WithFields(logrus.Fields{"err": err}).Error("反序列化data失败")
 			context.JSON(http.StatusOK, createResponseData(nil, err))
 		}
 	})
+	initCallback(engine)
+	initMass(engine)
 	engine.Run(address)
 	log.Info("结束web服务")
 }
@@ -184,6 +491,17 @@ func validate(context *gin.Context) {
 	}
 }
 
+//供其他服务调用的接口，除了登录态也接受Authorization: Bearer <TOKEN>
+func validateApi(context *gin.Context) {
+	authorization := context.GetHeader("Authorization")
+	if token != "" && strings.HasPrefix(authorization, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(authorization, "Bearer ")), []byte(token)) == 1 {
+		context.Next()
+		return
+	}
+	validate(context)
+}
+
 func setLogin(context *gin.Context) {
 	session := sessions.Default(context)
 	session.Set(secretKey, secret)
@@ -199,6 +517,8 @@ func isLogin(context *gin.Context) bool {
 func createResponseData(data interface{}, err error) interface{} {
 	if err == nil {
 		return gin.H{"code": 1, "massage": err, "data": data}
+	} else if weChatError, ok := wechat.AsWeChatError(err); ok {
+		return gin.H{"code": 2, "massage": err, "data": data, "errcode": weChatError.ErrCode, "errmsg": weChatError.ErrMsg, "api": weChatError.Api}
 	} else {
 		return gin.H{"code": 2, "massage": err, "data": data}
 	}
@@ -206,621 +526,45 @@ func createResponseData(data interface{}, err error) interface{} {
 
 //----------------------------------------------------------------------------------------------------------------------
 
-//获取全部用户信息
-func listAllUserInfo() ([]UserInfo, error) {
-	openIds, err := listAllOpenId()
-	if err != nil {
-		return nil, err
-	}
-	return listUserInfo(openIds)
-}
-
-//给标签用户发送模板消息
-func sendTemplateToTag(templateId string, tagId int, url string, dataMap map[string]string) ([]string, error) {
-	data := map[string]map[string]string{}
-	for key, value := range dataMap {
-		data[key] = map[string]string{"value": value}
-	}
-	log.WithFields(logrus.Fields{"data": data}).Info("重构模板数据")
-	openIds, err := listOpenIdByTagId(tagId)
-	if err != nil {
-		return nil, err
-	}
-	var failOpenIds []string
-	for i := range openIds {
-		success, _ := sendTemplate(openIds[i], templateId, url, data)
-		if !success {
-			failOpenIds = append(failOpenIds, openIds[i])
-		}
-	}
-	return failOpenIds, nil
-}
-
-//----------------------------------------------------------------------------------------------------------------------
-
-//获取全部模板
-func listAllTemplate() (templates []Template, err error) {
-	for i := 0; i < retry; i++ {
-		jsonString, err := requestListAllTemplate()
-		if err == nil {
-			return analysisListAllTemplate(jsonString)
-		}
-		flushAccessToken()
-	}
-	return nil, err
-}
-
-func analysisListAllTemplate(jsonString string) ([]Template, error) {
-	if !gjson.Valid(jsonString) {
-		log.Error("获取所有模板响应json非法")
-		return nil, errors.New("获取所有模板响应json非法")
-	}
-	result := gjson.Get(jsonString, "template_list")
-	if !result.Exists() {
-		log.Error("获取所有模板响应json没有template_list属性")
-		return nil, errors.New("获取所有模板响应json没有template_list属性")
-	}
-	var templates []Template
-	err := json.Unmarshal([]byte(result.String()), &templates)
-	if err != nil {
-		log.WithFields(logrus.Fields{"err": err}).Error("反序列化获取所有模板响应json失败")
-	} else {
-		log.WithFields(logrus.Fields{"templates": templates}).Info("获取所有模板成功")
-	}
-	return templates, err
-}
-
-func requestListAllTemplate() (string, error) {
-	request := gorequest.New()
-	response, body, errs := request.Get("https://api.weixin.qq.com/cgi-bin/template/get_all_private_template").
-		Param("access_token", getAccessToken()).
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("获取所有模板请求")
-	if errs != nil && len(errs) > 0 {
-		return "", errors.New("获取所有模板请求异常")
-	}
-	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode, "body": body}).Info("获取所有模板请求")
-	if response.StatusCode != 200 {
-		return "", errors.New("获取所有模板响应码异常")
-	}
-	return body, nil
-}
-
-//----------------------------------------------------------------------------------------------------------------------
-
-//获取全部openId
-func listAllOpenId() (openIds []string, err error) {
-	for i := 0; i < retry; i++ {
-		jsonString, err := requestListAllOpenId()
-		if err == nil {
-			return analysisListAllOpenId(jsonString)
-		}
-		flushAccessToken()
-	}
-	return nil, err
-}
-
-func analysisListAllOpenId(jsonString string) ([]string, error) {
-	if !gjson.Valid(jsonString) {
-		log.Error("获取全部openId响应json非法")
-		return nil, errors.New("获取全部openId响应json非法")
-	}
-	result := gjson.Get(jsonString, "data")
-	if !result.Exists() {
-		log.Error("获取全部openId响应json没有data属性")
-		return nil, errors.New("获取全部openId响应json没有data属性")
-	}
-	result = result.Get("openid")
-	if !result.Exists() {
-		log.Error("获取全部openId响应json没有openid属性")
-		return nil, errors.New("获取全部openId响应json没有openid属性")
-	}
-	var openIds []string
-	err := json.Unmarshal([]byte(result.String()), &openIds)
-	if err != nil {
-		log.WithFields(logrus.Fields{"err": err}).Error("反序列化获取全部openId响应json失败")
-	} else {
-		log.WithFields(logrus.Fields{"openIds": openIds}).Info("获取全部openId成功")
-	}
-	return openIds, err
-}
-
-func requestListAllOpenId() (string, error) {
-	request := gorequest.New()
-	response, body, errs := request.Get("https://api.weixin.qq.com/cgi-bin/user/get").
-		Param("access_token", getAccessToken()).
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("获取全部openId请求")
-	if errs != nil && len(errs) > 0 {
-		return "", errors.New("获取全部openId请求异常")
-	}
-	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode, "body": body}).Info("获取全部openId请求")
-	if response.StatusCode != 200 {
-		return "", errors.New("获取全部openId响应码异常")
-	}
-	return body, nil
-}
-
-//----------------------------------------------------------------------------------------------------------------------
-
-//获取用户信息
-func listUserInfo(openIds []string) (userInfos []UserInfo, err error) {
-	for i := 0; i < retry; i++ {
-		jsonString, err := requestListUserInfo(openIds)
-		if err == nil {
-			return analysisListUserInfo(jsonString)
-		}
-		flushAccessToken()
-	}
-	return nil, err
-}
-
-func analysisListUserInfo(jsonString string) ([]UserInfo, error) {
-	if !gjson.Valid(jsonString) {
-		log.Error("获取用户信息响应json非法")
-		return nil, errors.New("获取用户信息响应json非法")
-	}
-	userInfoList := gjson.Get(jsonString, "user_info_list")
-	if !userInfoList.Exists() {
-		log.Error("获取用户信息响应json没有user_info_list属性")
-		return nil, errors.New("获取用户信息响应json没有user_info_list属性")
-	}
-	var userInfos []UserInfo
-	err := json.Unmarshal([]byte(userInfoList.String()), &userInfos)
-	if err != nil {
-		log.WithFields(logrus.Fields{"err": err}).Error("反序列化获取用户信息响应json失败")
-	} else {
-		log.WithFields(logrus.Fields{"userInfos": userInfos}).Info("获取用户信息成功")
-	}
-	return userInfos, err
-}
-
-func requestListUserInfo(openIds []string) (string, error) {
-	var userList []map[string]interface{}
-	for i := range openIds {
-		userList = append(userList, map[string]interface{}{"openid": openIds[i], "lang": "zh_CN"})
-	}
-	log.WithFields(logrus.Fields{"userList": userList}).Info("获取用户信息请求参数")
-
-	request := gorequest.New()
-	response, body, errs := request.Post("https://api.weixin.qq.com/cgi-bin/user/info/batchget").
-		Set("Content-Type", "application/json;CHARSET=utf-8").
-		Param("access_token", getAccessToken()).
-		Send(
-			map[string]interface{}{
-				"user_list": userList,
-			}).
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("获取用户信息请求")
-	if errs != nil && len(errs) > 0 {
-		return "", errors.New("获取用户信息请求异常")
-	}
-	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode, "body": body}).Info("获取用户信息请求")
-	if response.StatusCode != 200 {
-		return "", errors.New("获取用户信息响应码异常")
-	}
-	return body, nil
-}
-
-//----------------------------------------------------------------------------------------------------------------------
-
-//为用户删标签
-func deleteTagFromUser(tagId int, openIds []string) (success bool, err error) {
-	for i := 0; i < retry; i++ {
-		jsonString, err := requestDeleteTagFromUser(tagId, openIds)
-		if err == nil {
-			return analysisDeleteTagFromUser(jsonString)
-		}
-		flushAccessToken()
-	}
-	return false, err
-}
-
-func analysisDeleteTagFromUser(jsonString string) (bool, error) {
-	if !gjson.Valid(jsonString) {
-		log.Error("为用户删标签响应json非法")
-		return false, errors.New("为用户删标签响应json非法")
-	}
-	result := gjson.Get(jsonString, "errcode")
-	success := result.Exists() && result.Int() == 0
-	log.WithFields(logrus.Fields{"success": success}).Info("为用户删标签结果")
-	if !success {
-		return false, errors.New("为用户删标签失败")
-	}
-	return success, nil
-}
-
-func requestDeleteTagFromUser(tagId int, openIds []string) (string, error) {
-	request := gorequest.New()
-	response, body, errs := request.Post("https://api.weixin.qq.com/cgi-bin/tags/members/batchuntagging").
-		Set("Content-Type", "application/json;CHARSET=utf-8").
-		Param("access_token", getAccessToken()).
-		Send(
-			map[string]interface{}{
-				"tagid":       tagId,
-				"openid_list": openIds,
-			}).
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("为用户删标签请求")
-	if errs != nil && len(errs) > 0 {
-		return "", errors.New("为用户删标签请求异常")
-	}
-	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode, "body": body}).Info("为用户删标签请求")
-	if response.StatusCode != 200 {
-		return "", errors.New("为用户删标签响应码异常")
-	}
-	return body, nil
-}
-
-//----------------------------------------------------------------------------------------------------------------------
-
-//为用户加标签
-func addTagToUser(tagId int, openIds []string) (success bool, err error) {
-	for i := 0; i < retry; i++ {
-		jsonString, err := requestAddTagToUser(tagId, openIds)
-		if err == nil {
-			return analysisAddTagToUser(jsonString)
-		}
-		flushAccessToken()
-	}
-	return false, err
-}
-
-func analysisAddTagToUser(jsonString string) (bool, error) {
-	if !gjson.Valid(jsonString) {
-		log.Error("为用户加标签响应json非法")
-		return false, errors.New("为用户加标签响应json非法")
-	}
-	result := gjson.Get(jsonString, "errcode")
-	success := result.Exists() && result.Int() == 0
-	log.WithFields(logrus.Fields{"success": success}).Info("为用户加标签结果")
-	if !success {
-		return false, errors.New("为用户加标签失败")
-	}
-	return success, nil
-}
-
-func requestAddTagToUser(tagId int, openIds []string) (string, error) {
-	request := gorequest.New()
-	response, body, errs := request.Post("https://api.weixin.qq.com/cgi-bin/tags/members/batchtagging").
-		Set("Content-Type", "application/json;CHARSET=utf-8").
-		Param("access_token", getAccessToken()).
-		Send(
-			map[string]interface{}{
-				"tagid":       tagId,
-				"openid_list": openIds,
-			}).
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("为用户加标签请求")
-	if errs != nil && len(errs) > 0 {
-		return "", errors.New("为用户加标签请求异常")
-	}
-	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode, "body": body}).Info("为用户加标签请求")
-	if response.StatusCode != 200 {
-		return "", errors.New("为用户加标签响应码异常")
-	}
-	return body, nil
-}
-
-//----------------------------------------------------------------------------------------------------------------------
-
-//获取标签下openid
-func listOpenIdByTagId(tagId int) (openIds []string, err error) {
-	for i := 0; i < retry; i++ {
-		jsonString, err := requestListOpenIdByTagId(tagId)
-		if err == nil {
-			return analysisListOpenIdByTagId(jsonString)
-		}
-	}
-	return nil, err
-}
-
-func analysisListOpenIdByTagId(jsonString string) ([]string, error) {
-	if !gjson.Valid(jsonString) {
-		log.Error("获取标签下openid响应json非法")
-		return nil, errors.New("获取标签下openid响应json非法")
-	}
-	result := gjson.Get(jsonString, "data")
-	if !result.Exists() {
-		log.Error("获取标签下openid响应json没有data属性")
-		return nil, errors.New("获取标签下openid响应json没有data属性")
-	}
-	result = gjson.Get(result.String(), "openid")
-	if !result.Exists() {
-		log.Error("获取标签下openid响应json没有openid属性")
-		return nil, errors.New("获取标签下openid响应json没有openid属性")
-	}
-	var openIds []string
-	err := json.Unmarshal([]byte(result.String()), &openIds)
-	if err != nil {
-		log.WithFields(logrus.Fields{"err": err}).Error("反序列化获取标签下openid响应json失败")
+//获取accessToken，stale为调用方被微信拒绝的accessToken，非空且仍是当前accessToken时强制刷新
+//只是过期的调用方不带stale，直接返回缓存，避免一个调用方的正常过期使所有调用方的accessToken失效
+func getAccessToken(ctx context.Context, stale string) (gin.H, error) {
+	var accessToken wechat.Token
+	var err error
+	if stale == "" {
+		accessToken, err = client.AccessToken(ctx)
 	} else {
-		log.WithFields(logrus.Fields{"openIds": openIds}).Info("获取标签下openid成功")
-	}
-	return openIds, err
-}
-
-func requestListOpenIdByTagId(tagId int) (string, error) {
-	request := gorequest.New()
-	response, body, errs := request.Post("https://api.weixin.qq.com/cgi-bin/user/tag/get").
-		Set("Content-Type", "application/json;CHARSET=utf-8").
-		Param("access_token", getAccessToken()).
-		Send(
-			map[string]interface{}{
-				"tagid":       tagId,
-				"next_openid": "",
-			}).
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("获取标签下openid请求")
-	if errs != nil && len(errs) > 0 {
-		return "", errors.New("获取标签下openid请求异常")
-	}
-
-	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode, "body": body}).Info("获取标签下openid请求")
-	if response.StatusCode != 200 {
-		return "", errors.New("获取标签下openid响应码异常")
-	}
-	return body, nil
-}
-
-//----------------------------------------------------------------------------------------------------------------------
-
-//删除标签
-func deleteTag(tagId int) (success bool, err error) {
-	for i := 0; i < retry; i++ {
-		jsonString, err := requestDeleteTag(tagId)
-		if err == nil {
-			return analysisDeleteTag(jsonString)
-		}
-		flushAccessToken()
-	}
-	return false, err
-}
-
-func analysisDeleteTag(jsonString string) (bool, error) {
-	if !gjson.Valid(jsonString) {
-		log.Error("删除标签响应json非法")
-		return false, errors.New("删除标签响应json非法")
-	}
-	result := gjson.Get(jsonString, "errcode")
-	success := result.Exists() && result.Int() == 0
-	log.WithFields(logrus.Fields{"success": success}).Info("删除标签结果")
-	if !success {
-		return false, errors.New("删除标签失败")
-	}
-	return success, nil
-}
-
-func requestDeleteTag(tagId int) (string, error) {
-	request := gorequest.New()
-	response, body, errs := request.Post("https://api.weixin.qq.com/cgi-bin/tags/delete").
-		Set("Content-Type", "application/json;CHARSET=utf-8").
-		Param("access_token", getAccessToken()).
-		Send(
-			map[string]interface{}{
-				"tag": map[string]interface{}{"id": tagId},
-			}).
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("删除标签请求")
-	if errs != nil && len(errs) > 0 {
-		return "", errors.New("删除标签请求异常")
-	}
-	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode, "body": body}).Info("删除标签请求")
-	if response.StatusCode != 200 {
-		return "", errors.New("删除标签请求响应码异常")
+		accessToken, err = client.RefreshAccessToken(ctx, stale)
 	}
-	return body, nil
-}
-
-//----------------------------------------------------------------------------------------------------------------------
-
-//获取所有标签
-func listAllTag() (tags []Tag, err error) {
-	for i := 0; i < retry; i++ {
-		jsonString, err := requestListAllTag()
-		if err == nil {
-			return analysisListAllTag(jsonString)
-		}
-		flushAccessToken()
-	}
-	return nil, err
-}
-
-func analysisListAllTag(jsonString string) ([]Tag, error) {
-	if !gjson.Valid(jsonString) {
-		log.Error("获取所有标签响应json非法")
-		return nil, errors.New("获取所有标签响应json非法")
-	}
-	result := gjson.Get(jsonString, "tags")
-	if !result.Exists() {
-		log.Error("获取所有标签响应json没有tags属性")
-		return nil, errors.New("获取所有标签响应json没有tags属性")
-	}
-	var tags []Tag
-	err := json.Unmarshal([]byte(result.String()), &tags)
 	if err != nil {
-		log.WithFields(logrus.Fields{"err": err}).Error("反序列化获取所有标签响应json失败")
-	} else {
-		log.WithFields(logrus.Fields{"tags": tags}).Info("获取所有标签成功")
-	}
-	return tags, err
-}
-
-func requestListAllTag() (string, error) {
-	request := gorequest.New()
-	response, body, errs := request.Get("https://api.weixin.qq.com/cgi-bin/tags/get").
-		Param("access_token", getAccessToken()).
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("获取所有标签请求")
-	if errs != nil && len(errs) > 0 {
-		return "", errors.New("获取所有标签请求异常")
-	}
-	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode, "body": body}).Info("获取所有标签请求")
-	if response.StatusCode != 200 {
-		return "", errors.New("获取所有标签响应码异常")
-	}
-	return body, nil
-}
-
-//----------------------------------------------------------------------------------------------------------------------
-
-//创建标签
-func createTag(tag string) (success bool, err error) {
-	for i := 0; i < retry; i++ {
-		jsonString, err := requestCreateTag(tag)
-		if err == nil {
-			return analysisCreateTag(jsonString)
-		}
-		flushAccessToken()
-	}
-	return false, err
-}
-
-func analysisCreateTag(jsonString string) (bool, error) {
-	if !gjson.Valid(jsonString) {
-		log.Error("创建标签响应json非法")
-		return false, errors.New("创建标签响应json非法")
-	}
-	result := gjson.Get(jsonString, "errcode")
-	success := !result.Exists()
-	log.WithFields(logrus.Fields{"success": success}).Info("创建标签结果")
-	if !success {
-		return false, errors.New("创建标签失败")
-	}
-	return success, nil
-}
-
-func requestCreateTag(tag string) (string, error) {
-	request := gorequest.New()
-	response, body, errs := request.Post("https://api.weixin.qq.com/cgi-bin/tags/create").
-		Set("Content-Type", "application/json;CHARSET=utf-8").
-		Param("access_token", getAccessToken()).
-		Send(
-			map[string]interface{}{
-				"tag": map[string]string{"name": tag},
-			}).
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("创建标签请求")
-	if errs != nil && len(errs) > 0 {
-		return "", errors.New("创建标签请求异常")
-	}
-	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode, "body": body}).Info("创建标签请求")
-	if response.StatusCode != 200 {
-		return "", errors.New("创建标签响应码异常")
-	}
-	return body, nil
-}
-
-//----------------------------------------------------------------------------------------------------------------------
-
-//发送模板信息
-func sendTemplate(openId string, templateId string, url string, data interface{}) (success bool, err error) {
-	for i := 0; i < retry; i++ {
-		jsonString, err := requestSendTemplate(openId, templateId, url, data)
-		if err == nil {
-			return analysisSendTemplate(jsonString)
-		}
-		flushAccessToken()
-	}
-	return false, err
-}
-
-func analysisSendTemplate(jsonString string) (bool, error) {
-	if !gjson.Valid(jsonString) {
-		log.Error("发送模板响应json非法")
-		return false, errors.New("发送模板响应json非法")
-	}
-	result := gjson.Get(jsonString, "errcode")
-	success := result.Exists() && result.Int() == 0
-	log.WithFields(logrus.Fields{"success": success}).Info("发送模板结果")
-	if !success {
-		return false, errors.New("发送模板失败")
-	}
-	return success, nil
-}
-
-func requestSendTemplate(openId string, templateId string, url string, data interface{}) (string, error) {
-	request := gorequest.New()
-	response, body, errs := request.Post("https://api.weixin.qq.com/cgi-bin/message/template/send").
-		Set("Content-Type", "application/json;CHARSET=utf-8").
-		Param("access_token", getAccessToken()).
-		Send(
-			map[string]interface{}{
-				"touser":      openId,
-				"template_id": templateId,
-				"url":         url,
-				"data":        data,
-			}).
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("发送模板信息请求")
-	if errs != nil && len(errs) > 0 {
-		return "", errors.New("发送模板信息请求异常")
-	}
-	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode, "body": body}).Info("发送模板信息请求")
-	if response.StatusCode != 200 {
-		return "", errors.New("发送模板信息响应码异常")
-	}
-	return body, nil
-}
-
-//----------------------------------------------------------------------------------------------------------------------
-
-//获取accessToken
-func getAccessToken() string {
-	if accessToken == "" {
-		flushAccessToken()
-	}
-	return accessToken
-}
-
-func autoFlushAccessToken() {
-	for {
-		flushAccessToken()
-		time.Sleep(30 * time.Minute)
+		return nil, err
 	}
+	return gin.H{
+		"access_token": accessToken.AccessToken,
+		"expires_in":   int64(accessToken.TTL() / time.Second),
+		"expires_at":   accessToken.ExpiresAt,
+	}, nil
 }
 
-func flushAccessToken() {
-	for i := 0; i < retry; i++ {
-		jsonString, err := requestAccessToken()
-		if err == nil {
-			accessToken, _ = analysisAccessToken(jsonString)
-			return
-		}
-	}
+//创建给标签用户发送模板消息的任务，返回的任务可以用/api/jobs/:id查询进度
+func sendTemplateToTag(templateId string, tagId int, url string, dataMap map[string]string) *Job {
+	return sendTemplate(templateId, url, dataMap, JobRecipients{TagIds: []int{tagId}})
 }
 
-func analysisAccessToken(jsonString string) (string, error) {
-	if !gjson.Valid(jsonString) {
-		log.Error("获取accessToken响应json非法")
-		return "", errors.New("获取accessToken响应json非法")
-	}
-	result := gjson.Get(jsonString, "access_token")
-	if !result.Exists() {
-		log.Error("获取accessToken响应json没有access_token属性")
-		return "", errors.New("获取accessToken响应json没有access_token属性")
-	}
-	token := result.String()
-	log.WithFields(logrus.Fields{"accessToken": len(token)}).Info("accessToken长度")
-	return token, nil
+//创建给openid、标签和全部关注用户发送模板消息的任务，收件人合并去重后发送
+func sendTemplate(templateId string, url string, dataMap map[string]string, recipients JobRecipients) *Job {
+	job := newTemplateJob(templateId, url, dataMap, recipients.target())
+	return jobs.start(job, recipients.list)
 }
 
-func requestAccessToken() (string, error) {
-	request := gorequest.New()
-	response, body, errs := request.Get("https://api.weixin.qq.com/cgi-bin/token").
-		Param("appid", appId).
-		Param("secret", appSecret).
-		Param("grant_type", "client_credential").
-		Timeout(timeout).End()
-	log.WithFields(logrus.Fields{"errs": errs}).Info("获取accessToken请求")
-	if errs != nil && len(errs) > 0 {
-		return "", errors.New("获取accessToken请求异常")
-	}
-	log.WithFields(logrus.Fields{"StatusCode": response.StatusCode, "body长度": len(body)}).Info("获取accessToken请求")
-	if response.StatusCode != 200 {
-		return "", errors.New("获取accessToken响应码异常")
+//把key-value的模板数据重构为微信要求的格式
+func newTemplateJob(templateId string, url string, dataMap map[string]string, target string) *Job {
+	data := map[string]map[string]string{}
+	for key, value := range dataMap {
+		data[key] = map[string]string{"value": value}
 	}
-	return body, nil
+	log.WithFields(logrus.Fields{"data": data}).Info("重构模板数据")
+	return &Job{TemplateId: templateId, Url: url, Data: data, Target: target}
 }
 
 //----------------------------------------------------------------------------------------------------------------------
@@ -918,6 +662,40 @@ var indexHtmlString = `<!DOCTYPE html>
     </b-input-group>
     <b-form-textarea :rows="rows" v-model="data" placeholder="data" @input="flushRows"></b-form-textarea>
 </div>
+<div id="job">
+    <b-input-group prepend="job">
+        <b-form-input placeholder="id" v-model="id"></b-form-input>
+        <b-input-group-append>
+            <b-button variant="info" @click="getJob">flush</b-button>
+            <b-button variant="danger" @click="cancelJob">cancel</b-button>
+        </b-input-group-append>
+    </b-input-group>
+    <b-form-textarea :rows="rows" v-model="json" @input="flushRows"></b-form-textarea>
+</div>
+<hr/>
+<div id="allRule">
+    <b-button-group style="width: 100%">
+        <b-button>allRule</b-button>
+        <b-button variant="info" @click="listAllRule">flush</b-button>
+    </b-button-group>
+    <b-form-textarea :rows="rows" v-model="json" @input="flushRows"></b-form-textarea>
+</div>
+<div id="saveRule">
+    <b-button-group style="width: 100%">
+        <b-button>saveRule</b-button>
+        <b-button variant="primary" @click="saveRule">save</b-button>
+    </b-button-group>
+    <b-form-textarea :rows="rows" v-model="rule" @input="flushRows"
+                     placeholder='{"match":"exact","keyword":"hi","reply":{"MsgType":"text","Content":"hello"}}'></b-form-textarea>
+</div>
+<div id="deleteRule">
+    <b-input-group prepend="deleteRule">
+        <b-form-input placeholder="id" v-model="id"></b-form-input>
+        <b-input-group-append>
+            <b-button variant="danger" @click="deleteRule">delete</b-button>
+        </b-input-group-append>
+    </b-input-group>
+</div>
 </body>
 <script src="//polyfill.io/v3/polyfill.js?features=es2015%2CIntersectionObserver" crossorigin="anonymous"></script>
 <script src="//unpkg.com/vue@latest/dist/vue.js"></script>
@@ -944,6 +722,7 @@ var indexHtmlString = `<!DOCTYPE html>
                             allTemplate.listAllTemplate()
                             allTag.listAllTag()
                             allUserInfo.listAllUserInfo()
+                            allRule.listAllRule()
                         } else {
                             alert('登录失败: ' + JSON.stringify(data.massage))
                         }
@@ -1253,7 +1032,9 @@ var indexHtmlString = `<!DOCTYPE html>
                     error: ajaxErrorDeal,
                     success: function (data) {
                         if (data.code == 1) {
-                            alert('给标签用户发送模板消息成功')
+                            alert('已创建给标签用户发送模板消息的任务: ' + data.data.id)
+                            job.id = data.data.id
+                            job.getJob()
                         } else {
                             alert('给标签用户发送模板消息失败: ' + JSON.stringify(data.massage))
                         }
@@ -1266,6 +1047,162 @@ var indexHtmlString = `<!DOCTYPE html>
         },
     })
 
+    var job = new Vue({
+        el: '#job',
+        data: {
+            id: "",
+            json: "",
+            rows: 1,
+        },
+        methods: {
+            getJob: function () {
+                $.ajax({
+                    url: 'api/jobs/' + encodeURIComponent(job.id),
+                    type: 'get',
+                    data: {},
+                    contentType: "application/x-www-form-urlencoded",
+                    dataType: "json",
+                    error: ajaxErrorDeal,
+                    success: function (data) {
+                        if (data.code == 1) {
+                            job.json = JSON.stringify(data.data, null, 2);
+                        } else {
+                            job.json = JSON.stringify(data.massage)
+                        }
+                        if (job.json == null) {
+                            job.json = ""
+                        }
+                        job.rows = job.json.split("\n").length
+                    }
+                });
+            },
+            cancelJob: function () {
+                if (!window.confirm("cancelJob？")) {
+                    return
+                }
+                $.ajax({
+                    url: 'api/jobs/' + encodeURIComponent(job.id) + '/cancel',
+                    type: 'post',
+                    data: {},
+                    contentType: "application/x-www-form-urlencoded",
+                    dataType: "json",
+                    error: ajaxErrorDeal,
+                    success: function (data) {
+                        if (data.code == 1) {
+                            alert('取消任务成功')
+                            job.getJob()
+                        } else {
+                            alert('取消任务失败: ' + JSON.stringify(data.massage))
+                        }
+                    }
+                });
+            },
+            flushRows: function (text) {
+                job.rows = text.split("\n").length
+            },
+        },
+    })
+
+    var allRule = new Vue({
+        el: '#allRule',
+        data: {
+            json: "",
+            rows: 1,
+        },
+        methods: {
+            listAllRule: function () {
+                $.ajax({
+                    url: 'listAllRule',
+                    type: 'get',
+                    data: {},
+                    contentType: "application/x-www-form-urlencoded",
+                    dataType: "json",
+                    error: ajaxErrorDeal,
+                    success: function (data) {
+                        if (data.code == 1) {
+                            allRule.json = JSON.stringify(data.data, null, 2);
+                        } else {
+                            allRule.json = JSON.stringify(data.massage)
+                        }
+                        if (allRule.json == null) {
+                            allRule.json = ""
+                        }
+                        allRule.rows = allRule.json.split("\n").length
+                    }
+                });
+            },
+            flushRows: function (text) {
+                allRule.rows = text.split("\n").length
+            },
+        },
+    })
+
+    var saveRule = new Vue({
+        el: '#saveRule',
+        data: {
+            rows: 1,
+            rule: "",
+        },
+        methods: {
+            saveRule: function () {
+                if (!window.confirm("saveRule？")) {
+                    return
+                }
+                $.ajax({
+                    url: 'saveRule',
+                    type: 'post',
+                    data: {"rule": saveRule.rule},
+                    contentType: "application/x-www-form-urlencoded",
+                    dataType: "json",
+                    error: ajaxErrorDeal,
+                    success: function (data) {
+                        if (data.code == 1) {
+                            alert('保存规则成功')
+                            saveRule.rule = ""
+                            allRule.listAllRule()
+                        } else {
+                            alert('保存规则失败: ' + JSON.stringify(data.massage))
+                        }
+                    }
+                });
+            },
+            flushRows: function (text) {
+                saveRule.rows = text.split("\n").length
+            },
+        },
+    })
+
+    var deleteRule = new Vue({
+        el: '#deleteRule',
+        data: {
+            id: "",
+        },
+        methods: {
+            deleteRule: function () {
+                if (!window.confirm("deleteRule？")) {
+                    return
+                }
+                $.ajax({
+                    url: 'deleteRule',
+                    type: 'post',
+                    data: {"id": deleteRule.id},
+                    contentType: "application/x-www-form-urlencoded",
+                    dataType: "json",
+                    error: ajaxErrorDeal,
+                    success: function (data) {
+                        if (data.code == 1) {
+                            alert('删除规则成功')
+                            deleteRule.id = ""
+                            allRule.listAllRule()
+                        } else {
+                            alert('删除规则失败: ' + JSON.stringify(data.massage))
+                        }
+                    }
+                });
+            },
+        },
+    })
+
     function ajaxErrorDeal() {
         alert("网络错误!");
     }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"net/http"
+	"strconv"
+	"time"
+	"wxGateway/wechat"
+)
+
+//本网关发起的群发及MASSSENDJOBFINISH推送的最终统计
+type MassRecord struct {
+	MsgId      int64  `json:"msg_id"`
+	MsgDataId  int64  `json:"msg_data_id,omitempty"`
+	MsgType    string `json:"msgtype,omitempty"`
+	Target     string `json:"target,omitempty"`
+	CreateTime int64  `json:"create_time,omitempty"`
+	//以下为发送结果事件的统计，Status为空表示还没收到推送
+	Status      string `json:"status"`
+	TotalCount  int    `json:"total_count"`
+	FilterCount int    `json:"filter_count"`
+	SentCount   int    `json:"sent_count"`
+	ErrorCount  int    `json:"error_count"`
+	FinishTime  int64  `json:"finish_time,omitempty"`
+}
+
+//查询条件，Before为上一页最后一条的msg_id
+type MassQuery struct {
+	Before int64 `form:"before"`
+	Limit  int   `form:"limit"`
+}
+
+const defaultMassRecordLimit = 100
+const maxMassRecordLimit = 1000
+
+var massRecordsBucket = []byte("massRecords")
+
+//bbolt中保存的群发记录，key为msg_id
+type massRecordStore struct {
+	db *bolt.DB
+}
+
+var massRecords *massRecordStore
+
+func newMassRecordStore(db *bolt.DB) (*massRecordStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(massRecordsBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &massRecordStore{db: db}, nil
+}
+
+func sequenceKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+//读出msgId的记录交给update修改后保存，没有记录时从空记录开始
+func (store *massRecordStore) update(msgId int64, update func(record *MassRecord)) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(massRecordsBucket)
+		key := sequenceKey(uint64(msgId))
+		record := MassRecord{MsgId: msgId}
+		if data := bucket.Get(key); data != nil {
+			err := json.Unmarshal(data, &record)
+			if err != nil {
+				return err
+			}
+		}
+		update(&record)
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+}
+
+func (store *massRecordStore) add(result wechat.MassResult, message wechat.MassMessage, target string) {
+	err := store.update(result.MsgId, func(record *MassRecord) {
+		record.MsgDataId = result.MsgDataId
+		record.MsgType = message.MsgType
+		record.Target = target
+		record.CreateTime = time.Now().Unix()
+	})
+	if err != nil {
+		log.WithFields(logrus.Fields{"result": result, "err": err}).Error("保存群发记录失败")
+	}
+}
+
+//推送可能先于群发接口返回，也可能是公众平台后台发起的群发
+func (store *massRecordStore) finish(event wechat.MassSendJobFinishEvent) error {
+	return store.update(event.MsgId, func(record *MassRecord) {
+		record.Status = event.Status
+		record.TotalCount = event.TotalCount
+		record.FilterCount = event.FilterCount
+		record.SentCount = event.SentCount
+		record.ErrorCount = event.ErrorCount
+		record.FinishTime = event.CreateTime
+	})
+}
+
+func (store *massRecordStore) get(msgId int64) (*MassRecord, error) {
+	var record *MassRecord
+	err := store.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(massRecordsBucket).Get(sequenceKey(uint64(msgId)))
+		if data == nil {
+			return nil
+		}
+		record = &MassRecord{}
+		return json.Unmarshal(data, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+//按msg_id倒序
+func (store *massRecordStore) query(query MassQuery) ([]MassRecord, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultMassRecordLimit
+	}
+	if query.Limit > maxMassRecordLimit {
+		query.Limit = maxMassRecordLimit
+	}
+	records := make([]MassRecord, 0, query.Limit)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(massRecordsBucket).Cursor()
+		var key, value []byte
+		if query.Before > 0 {
+			cursor.Seek(sequenceKey(uint64(query.Before)))
+			key, value = cursor.Prev()
+		} else {
+			key, value = cursor.Last()
+		}
+		for ; key != nil && len(records) < query.Limit; key, value = cursor.Prev() {
+			var record MassRecord
+			err := json.Unmarshal(value, &record)
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+		return nil
+	})
+	return records, err
+}
+
+//记录群发消息发送结果事件
+func massSendJobFinishRecorder(ctx context.Context, event wechat.Event) error {
+	finish, ok := event.(wechat.MassSendJobFinishEvent)
+	if !ok {
+		return nil
+	}
+	err := massRecords.finish(finish)
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{"event": finish}).Info("记录群发结果")
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//群发接口，请求json与微信接口相同
+func initMass(engine *gin.Engine) {
+	engine.POST("/api/mass/sendall", validateApi, idempotent, func(context *gin.Context) {
+		var request struct {
+			Filter wechat.MassFilter `json:"filter"`
+			wechat.MassMessage
+		}
+		if !bindMassRequest(context, &request) {
+			return
+		}
+		result, err := client.SendMassToTag(context.Request.Context(), request.Filter.TagId, request.Filter.IsToAll, request.MassMessage)
+		recordMassMessage("", request.MassMessage, request, result, err)
+		if err == nil {
+			target := "tag:" + strconv.Itoa(request.Filter.TagId)
+			if request.Filter.IsToAll {
+				target = "all"
+			}
+			massRecords.add(result, request.MassMessage, target)
+		}
+		context.JSON(http.StatusOK, createResponseData(result, err))
+	})
+	engine.POST("/api/mass/send", validateApi, idempotent, func(context *gin.Context) {
+		var request struct {
+			ToUser []string `json:"touser"`
+			wechat.MassMessage
+		}
+		if !bindMassRequest(context, &request) {
+			return
+		}
+		result, err := client.SendMassToUsers(context.Request.Context(), request.ToUser, request.MassMessage)
+		recordMassMessage("", request.MassMessage, request, result, err)
+		if err == nil {
+			massRecords.add(result, request.MassMessage, "openid:"+strconv.Itoa(len(request.ToUser)))
+		}
+		context.JSON(http.StatusOK, createResponseData(result, err))
+	})
+	engine.POST("/api/mass/preview", validateApi, idempotent, func(context *gin.Context) {
+		var request struct {
+			ToUser string `json:"touser"`
+			wechat.MassMessage
+		}
+		if !bindMassRequest(context, &request) {
+			return
+		}
+		result, err := client.PreviewMass(context.Request.Context(), request.ToUser, request.MassMessage)
+		recordMassMessage(request.ToUser, request.MassMessage, request, result, err)
+		context.JSON(http.StatusOK, createResponseData(result, err))
+	})
+	engine.POST("/api/mass/delete", validateApi, func(context *gin.Context) {
+		var request struct {
+			MsgId      int64 `json:"msg_id"`
+			ArticleIdx int   `json:"article_idx"`
+		}
+		if !bindMassRequest(context, &request) {
+			return
+		}
+		context.JSON(http.StatusOK, createResponseData(client.DeleteMass(context.Request.Context(), request.MsgId, request.ArticleIdx)))
+	})
+	engine.GET("/api/mass", validateApi, func(context *gin.Context) {
+		var query MassQuery
+		err := context.ShouldBindQuery(&query)
+		log.WithFields(logrus.Fields{"query": query}).Info("查询群发记录")
+		if err != nil {
+			log.WithFields(logrus.Fields{"err": err}).Error("群发记录查询参数非法")
+			context.JSON(http.StatusOK, createResponseData(nil, err))
+			return
+		}
+		context.JSON(http.StatusOK, createResponseData(massRecords.query(query)))
+	})
+	//微信的群发状态和收到的发送结果统计
+	engine.GET("/api/mass/:msgId", validateApi, func(context *gin.Context) {
+		msgIdString := context.Param("msgId")
+		log.WithFields(logrus.Fields{"msgId": msgIdString}).Info("查询群发状态")
+		msgId, err := strconv.ParseInt(msgIdString, 10, 64)
+		if err != nil {
+			log.Error("msgId参数非法")
+			context.JSON(http.StatusOK, createResponseData(nil, err))
+			return
+		}
+		status, err := client.GetMass(context.Request.Context(), msgId)
+		data := gin.H{"msg_id": msgId, "msg_status": status.MsgStatus}
+		if record, recordErr := massRecords.get(msgId); recordErr != nil {
+			log.WithFields(logrus.Fields{"msgId": msgId, "err": recordErr}).Error("读取群发记录失败")
+		} else if record != nil {
+			data["record"] = record
+		}
+		context.JSON(http.StatusOK, createResponseData(data, err))
+	})
+}
+
+//群发也保存到消息记录，群发没有单个收件人，只有预览时openId为预览的用户
+func recordMassMessage(openId string, message wechat.MassMessage, request interface{}, result wechat.MassResult, err error) {
+	recordMessage(MessageRecord{
+		Type:    MessageTypeMass,
+		OpenId:  openId,
+		MsgType: message.MsgType,
+		Data:    request,
+		MsgId:   result.MsgId,
+	}, err)
+}
+
+func bindMassRequest(context *gin.Context, request interface{}) bool {
+	err := context.ShouldBindJSON(request)
+	log.WithFields(logrus.Fields{"request": request}).Info("群发请求参数")
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("反序列化群发请求失败")
+		context.JSON(http.StatusOK, createResponseData(nil, err))
+		return false
+	}
+	return true
+}
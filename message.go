@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	bolt "go.etcd.io/bbolt"
+	"time"
+	"wxGateway/wechat"
+)
+
+//发出的消息类型
+const (
+	MessageTypeTemplate = "template"
+	MessageTypeCustom   = "custom"
+	MessageTypeMass     = "mass"
+)
+
+//发出的消息状态
+const (
+	MessageStatusSent   = "sent"
+	MessageStatusFailed = "failed"
+)
+
+//查询消息记录默认和最多返回的条数
+const defaultMessageLimit = 100
+const maxMessageLimit = 1000
+
+var messagesBucket = []byte("messages")
+
+//微信msgid到消息记录Id的索引，用于关联模板消息的发送结果事件
+var messageMsgIdsBucket = []byte("messageMsgIds")
+
+//先于消息记录到达的发送结果事件，key为msgid，保存消息记录时取出
+var messageDeliveriesBucket = []byte("messageDeliveries")
+
+//暂存的发送结果超过这个时间还没有对应的消息记录，说明不是本网关发出的消息，清理掉
+var pendingDeliveryWindow = time.Hour
+
+//发出的一条消息，Id递增，越新越大
+type MessageRecord struct {
+	Id         uint64      `json:"id"`
+	Type       string      `json:"type"`
+	OpenId     string      `json:"openId"`
+	TemplateId string      `json:"templateId,omitempty"`
+	MsgType    string      `json:"msgType,omitempty"`
+	Url        string      `json:"url,omitempty"`
+	Data       interface{} `json:"data,omitempty"`
+	JobId      string      `json:"jobId,omitempty"`
+	MsgId      int64       `json:"msgId,omitempty"`
+	Status     string      `json:"status"`
+	ErrCode    int         `json:"errcode,omitempty"`
+	ErrMsg     string      `json:"errmsg,omitempty"`
+	//TEMPLATESENDJOBFINISH推送的真实送达结果，为空表示还没收到推送
+	Delivery     string `json:"delivery,omitempty"`
+	DeliveryTime int64  `json:"deliveryTime,omitempty"`
+	CreateTime   int64  `json:"createTime"`
+	UpdateTime   int64  `json:"updateTime"`
+}
+
+//查询条件，为空的条件不过滤，Since和Until为秒级时间戳，Before为上一页最后一条的Id
+type MessageQuery struct {
+	Type       string `form:"type"`
+	OpenId     string `form:"openId"`
+	TemplateId string `form:"templateId"`
+	Status     string `form:"status"`
+	Delivery   string `form:"delivery"`
+	Since      int64  `form:"since"`
+	Until      int64  `form:"until"`
+	Before     uint64 `form:"before"`
+	Limit      int    `form:"limit"`
+}
+
+func (query MessageQuery) match(record *MessageRecord) bool {
+	return (query.Type == "" || query.Type == record.Type) &&
+		(query.OpenId == "" || query.OpenId == record.OpenId) &&
+		(query.TemplateId == "" || query.TemplateId == record.TemplateId) &&
+		(query.Status == "" || query.Status == record.Status) &&
+		(query.Delivery == "" || query.Delivery == record.Delivery) &&
+		(query.Until == 0 || record.CreateTime <= query.Until)
+}
+
+//bbolt中保存的发出消息记录
+type messageStore struct {
+	db *bolt.DB
+	//下次清理暂存发送结果的时间，只在写事务中读写
+	sweepAt time.Time
+}
+
+//暂存的发送结果
+type pendingDelivery struct {
+	Delivery     string `json:"delivery"`
+	DeliveryTime int64  `json:"deliveryTime"`
+	CreateTime   int64  `json:"createTime"`
+}
+
+var messages *messageStore
+
+func newMessageStore(db *bolt.DB) (*messageStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(messagesBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(messageMsgIdsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(messageDeliveriesBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &messageStore{db: db}, nil
+}
+
+func (store *messageStore) add(record *MessageRecord) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(messagesBucket)
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		record.Id = id
+		//群发的msg_id与模板消息的msgid不是同一套，只有模板消息需要关联发送结果事件
+		indexed := record.MsgId != 0 && record.Type == MessageTypeTemplate
+		if indexed {
+			err = takePendingDelivery(tx, record)
+			if err != nil {
+				return err
+			}
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put(sequenceKey(id), data)
+		if err != nil || !indexed {
+			return err
+		}
+		return tx.Bucket(messageMsgIdsBucket).Put(sequenceKey(uint64(record.MsgId)), sequenceKey(id))
+	})
+}
+
+//发送结果事件可能在发送接口返回之前到达，取出暂存的结果写入记录
+func takePendingDelivery(tx *bolt.Tx, record *MessageRecord) error {
+	bucket := tx.Bucket(messageDeliveriesBucket)
+	key := sequenceKey(uint64(record.MsgId))
+	data := bucket.Get(key)
+	if data == nil {
+		return nil
+	}
+	var pending pendingDelivery
+	err := json.Unmarshal(data, &pending)
+	if err != nil {
+		return err
+	}
+	record.Delivery = pending.Delivery
+	record.DeliveryTime = pending.DeliveryTime
+	return bucket.Delete(key)
+}
+
+//暂存还没有消息记录的发送结果，每个pendingDeliveryWindow顺便清理一次过期的
+func (store *messageStore) putPendingDelivery(tx *bolt.Tx, msgId int64, delivery string, deliveryTime int64) error {
+	bucket := tx.Bucket(messageDeliveriesBucket)
+	now := time.Now()
+	if now.After(store.sweepAt) {
+		store.sweepAt = now.Add(pendingDeliveryWindow)
+		expireAt := now.Add(-pendingDeliveryWindow).Unix()
+		var expiredKeys [][]byte
+		bucket.ForEach(func(key, value []byte) error {
+			if gjson.GetBytes(value, "createTime").Int() < expireAt {
+				expiredKeys = append(expiredKeys, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		for _, expiredKey := range expiredKeys {
+			bucket.Delete(expiredKey)
+		}
+	}
+	data, err := json.Marshal(pendingDelivery{Delivery: delivery, DeliveryTime: deliveryTime, CreateTime: now.Unix()})
+	if err != nil {
+		return err
+	}
+	return bucket.Put(sequenceKey(uint64(msgId)), data)
+}
+
+//用msgid找到消息记录并更新送达结果，还没有消息记录时暂存结果并返回nil
+func (store *messageStore) deliver(msgId int64, delivery string, deliveryTime int64) (*MessageRecord, error) {
+	var record *MessageRecord
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		id := tx.Bucket(messageMsgIdsBucket).Get(sequenceKey(uint64(msgId)))
+		if id == nil {
+			return store.putPendingDelivery(tx, msgId, delivery, deliveryTime)
+		}
+		key := append([]byte(nil), id...)
+		bucket := tx.Bucket(messagesBucket)
+		data := bucket.Get(key)
+		if data == nil {
+			return nil
+		}
+		record = &MessageRecord{}
+		err := json.Unmarshal(data, record)
+		if err != nil {
+			return err
+		}
+		record.Delivery = delivery
+		record.DeliveryTime = deliveryTime
+		record.UpdateTime = time.Now().Unix()
+		data, err = json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+//从新到旧遍历，早于Since时停止
+func (store *messageStore) query(query MessageQuery) ([]MessageRecord, error) {
+	if query.Limit <= 0 {
+		query.Limit = defaultMessageLimit
+	}
+	if query.Limit > maxMessageLimit {
+		query.Limit = maxMessageLimit
+	}
+	records := make([]MessageRecord, 0, query.Limit)
+	err := store.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(messagesBucket).Cursor()
+		var key, value []byte
+		if query.Before > 0 {
+			cursor.Seek(sequenceKey(query.Before))
+			key, value = cursor.Prev()
+		} else {
+			key, value = cursor.Last()
+		}
+		for ; key != nil && len(records) < query.Limit; key, value = cursor.Prev() {
+			var record MessageRecord
+			err := json.Unmarshal(value, &record)
+			if err != nil {
+				return err
+			}
+			if query.Since > 0 && record.CreateTime < query.Since {
+				break
+			}
+			if query.match(&record) {
+				records = append(records, record)
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+//保存发出的消息，失败只记录日志，不影响发送
+func recordMessage(record MessageRecord, err error) {
+	now := time.Now().Unix()
+	record.CreateTime = now
+	record.UpdateTime = now
+	record.Status = MessageStatusSent
+	if err != nil {
+		record.Status = MessageStatusFailed
+		record.ErrCode, record.ErrMsg = errorCodeAndMessage(err)
+	}
+	if storeErr := messages.add(&record); storeErr != nil {
+		log.WithFields(logrus.Fields{"record": record, "err": storeErr}).Error("保存消息记录失败")
+		return
+	}
+	if record.Delivery != "" && record.JobId != "" {
+		jobs.deliver(record.JobId, record.MsgId, record.Delivery)
+	}
+}
+
+//用模板消息发送结果事件更新消息记录和所属任务的送达结果
+func templateSendJobFinishRecorder(ctx context.Context, event wechat.Event) error {
+	finish, ok := event.(wechat.TemplateSendJobFinishEvent)
+	if !ok {
+		return nil
+	}
+	record, err := messages.deliver(finish.MsgId, finish.Status, finish.CreateTime)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		log.WithFields(logrus.Fields{"event": finish}).Info("还没有模板消息发送记录，暂存送达结果")
+		return nil
+	}
+	if record.JobId != "" {
+		jobs.deliver(record.JobId, finish.MsgId, finish.Status)
+	}
+	log.WithFields(logrus.Fields{"event": finish, "id": record.Id, "jobId": record.JobId}).Info("记录模板消息送达结果")
+	return nil
+}
+
+//微信错误取errcode和errmsg，其他错误只有errmsg
+func errorCodeAndMessage(err error) (int, string) {
+	if weChatError, ok := wechat.AsWeChatError(err); ok {
+		return weChatError.ErrCode, weChatError.ErrMsg
+	}
+	return 0, err.Error()
+}
+
+//发送客服消息并保存记录
+func sendCustomMessage(ctx context.Context, message wechat.CustomMessage) error {
+	err := client.SendCustomMessage(ctx, message)
+	recordMessage(MessageRecord{
+		Type:    MessageTypeCustom,
+		OpenId:  message.ToUser,
+		MsgType: message.MsgType,
+		Data:    message,
+	}, err)
+	return err
+}
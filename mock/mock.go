@@ -0,0 +1,687 @@
+package mock
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Template struct {
+	TemplateId string `json:"template_id"`
+	Title      string `json:"title"`
+}
+
+type Tag struct {
+	Id    int    `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type User struct {
+	OpenId    string `json:"openid"`
+	Nickname  string `json:"nickname"`
+	TagIdList []int  `json:"tagid_list"`
+}
+
+type SentTemplate struct {
+	MsgId      int64       `json:"msgid"`
+	ToUser     string      `json:"touser"`
+	TemplateId string      `json:"template_id"`
+	Url        string      `json:"url"`
+	Data       interface{} `json:"data"`
+}
+
+type SentCustomMessage struct {
+	ToUser  string                 `json:"touser"`
+	MsgType string                 `json:"msgtype"`
+	Message map[string]interface{} `json:"message"`
+}
+
+//模拟微信公众号接口，用于在CI和测试环境中代替api.weixin.qq.com
+type Server struct {
+	AppId     string
+	AppSecret string
+
+	mutex       sync.Mutex
+	accessToken string
+	stableToken string
+	templates   []Template
+	tags        map[int]*Tag
+	users       map[string]*User
+	nextTagId   int
+	nextMsgId   int64
+	sent        []SentTemplate
+	sentCustom  []SentCustomMessage
+	expired     map[string]bool
+	masses      map[int64]string
+	//拒收模板消息的用户，发送时返回43004
+	unsubscribed map[string]bool
+	//用户剩余的系统繁忙次数，发送时返回-1
+	busy map[string]int
+	//获取openid列表时每页的数量，与微信相同默认为10000
+	pageSize int
+	//每秒最多发送的模板消息数，0为不限制
+	templateRate  int
+	templateSlot  int64
+	templateCount int
+	//因超过templateRate返回45009的次数
+	templateThrottled int
+}
+
+func NewServer(appId string, appSecret string) *Server {
+	return &Server{
+		AppId:        appId,
+		AppSecret:    appSecret,
+		tags:         map[int]*Tag{},
+		users:        map[string]*User{},
+		expired:      map[string]bool{},
+		masses:       map[int64]string{},
+		unsubscribed: map[string]bool{},
+		busy:         map[string]int{},
+		nextTagId:    100,
+		nextMsgId:    1000000,
+		pageSize:     10000,
+	}
+}
+
+//添加模板
+func (server *Server) AddTemplate(templateId string, title string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.templates = append(server.templates, Template{TemplateId: templateId, Title: title})
+}
+
+//添加关注用户
+func (server *Server) AddUser(openId string, nickname string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.users[openId] = &User{OpenId: openId, Nickname: nickname, TagIdList: []int{}}
+}
+
+//模拟用户超过48小时没有互动，之后给该用户发客服消息返回45015
+func (server *Server) ExpireInteraction(openId string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.expired[openId] = true
+}
+
+//模拟用户拒收消息，之后给该用户发模板消息返回43004
+func (server *Server) Unsubscribe(openId string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.unsubscribed[openId] = true
+}
+
+//给该用户发送的后count条模板消息返回-1系统繁忙
+func (server *Server) FailTemplates(openId string, count int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.busy[openId] = count
+}
+
+//设置获取openid列表时每页的数量，用于测试分页
+func (server *Server) SetPageSize(pageSize int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.pageSize = pageSize
+}
+
+//限制每秒发送的模板消息数，超过时返回45009
+func (server *Server) LimitTemplateRate(perSecond int) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.templateRate = perSecond
+}
+
+//获取已发送的模板消息
+func (server *Server) SentTemplates() []SentTemplate {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]SentTemplate(nil), server.sent...)
+}
+
+//获取因超过频率限制返回45009的模板消息数
+func (server *Server) ThrottledTemplates() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.templateThrottled
+}
+
+//获取已发送的客服消息
+func (server *Server) SentCustomMessages() []SentCustomMessage {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]SentCustomMessage(nil), server.sentCustom...)
+}
+
+//使当前accessToken失效，模拟其他服务刷新了accessToken
+func (server *Server) InvalidateAccessToken() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.accessToken = ""
+	server.stableToken = ""
+}
+
+func (server *Server) Handler() http.Handler {
+	engine := gin.New()
+	engine.Use(gin.Recovery())
+
+	engine.GET("/cgi-bin/token", server.getToken)
+	engine.POST("/cgi-bin/stable_token", server.getStableToken)
+	cgi := engine.Group("/cgi-bin", server.checkAccessToken)
+	cgi.GET("/template/get_all_private_template", server.listAllTemplate)
+	cgi.GET("/user/get", server.listAllOpenId)
+	cgi.POST("/user/info/batchget", server.listUserInfo)
+	cgi.POST("/tags/members/batchtagging", server.addTagToUser)
+	cgi.POST("/tags/members/batchuntagging", server.deleteTagFromUser)
+	cgi.POST("/user/tag/get", server.listOpenIdByTagId)
+	cgi.GET("/tags/get", server.listAllTag)
+	cgi.POST("/tags/create", server.createTag)
+	cgi.POST("/tags/delete", server.deleteTag)
+	cgi.POST("/message/template/send", server.sendTemplate)
+	cgi.POST("/message/custom/send", server.sendCustomMessage)
+	cgi.POST("/message/custom/typing", server.sendTyping)
+	cgi.POST("/message/mass/sendall", server.sendMass)
+	cgi.POST("/message/mass/send", server.sendMass)
+	cgi.POST("/message/mass/preview", server.previewMass)
+	cgi.POST("/message/mass/get", server.getMass)
+	cgi.POST("/message/mass/delete", server.deleteMass)
+	return engine
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+func writeError(context *gin.Context, errcode int, errmsg string) {
+	context.Abort()
+	context.JSON(http.StatusOK, gin.H{"errcode": errcode, "errmsg": errmsg})
+}
+
+func writeOk(context *gin.Context) {
+	context.JSON(http.StatusOK, gin.H{"errcode": 0, "errmsg": "ok"})
+}
+
+func bindJson(context *gin.Context, object interface{}) bool {
+	err := json.NewDecoder(context.Request.Body).Decode(object)
+	if err != nil {
+		writeError(context, 47001, "data format error")
+		return false
+	}
+	return true
+}
+
+func (server *Server) checkCredential(context *gin.Context, grantType string, appId string, secret string) bool {
+	if grantType != "client_credential" {
+		writeError(context, 40002, "invalid grant_type")
+		return false
+	}
+	if appId != server.AppId {
+		writeError(context, 40013, "invalid appid")
+		return false
+	}
+	if secret != server.AppSecret {
+		writeError(context, 40125, "invalid appsecret")
+		return false
+	}
+	return true
+}
+
+func newAccessToken() string {
+	return fmt.Sprintf("mock_%d_%d", time.Now().UnixNano(), rand.Int63())
+}
+
+//普通accessToken，每次获取都会使上一个失效
+func (server *Server) getToken(context *gin.Context) {
+	if !server.checkCredential(context, context.Query("grant_type"), context.Query("appid"), context.Query("secret")) {
+		return
+	}
+	server.mutex.Lock()
+	server.accessToken = newAccessToken()
+	accessToken := server.accessToken
+	server.mutex.Unlock()
+	context.JSON(http.StatusOK, gin.H{"access_token": accessToken, "expires_in": 7200})
+}
+
+//稳定版accessToken，与普通accessToken互不影响，只有强制刷新才会换新
+func (server *Server) getStableToken(context *gin.Context) {
+	var request struct {
+		GrantType    string `json:"grant_type"`
+		AppId        string `json:"appid"`
+		Secret       string `json:"secret"`
+		ForceRefresh bool   `json:"force_refresh"`
+	}
+	if !bindJson(context, &request) {
+		return
+	}
+	if !server.checkCredential(context, request.GrantType, request.AppId, request.Secret) {
+		return
+	}
+	server.mutex.Lock()
+	if server.stableToken == "" || request.ForceRefresh {
+		server.stableToken = newAccessToken()
+	}
+	stableToken := server.stableToken
+	server.mutex.Unlock()
+	context.JSON(http.StatusOK, gin.H{"access_token": stableToken, "expires_in": 7200})
+}
+
+func (server *Server) checkAccessToken(context *gin.Context) {
+	accessToken := context.Query("access_token")
+	server.mutex.Lock()
+	valid := accessToken != "" && (accessToken == server.accessToken || accessToken == server.stableToken)
+	server.mutex.Unlock()
+	if !valid {
+		writeError(context, 40001, "invalid credential, access_token is invalid or not latest")
+		return
+	}
+	context.Next()
+}
+
+func (server *Server) listAllTemplate(context *gin.Context) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	templates := append([]Template{}, server.templates...)
+	context.JSON(http.StatusOK, gin.H{"template_list": templates})
+}
+
+func (server *Server) sortedOpenIds(filter func(user *User) bool) []string {
+	openIds := []string{}
+	for openId, user := range server.users {
+		if filter(user) {
+			openIds = append(openIds, openId)
+		}
+	}
+	sort.Strings(openIds)
+	return openIds
+}
+
+func (server *Server) listAllOpenId(context *gin.Context) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	openIds := server.sortedOpenIds(func(user *User) bool { return true })
+	page := server.openIdPage(openIds, context.Query("next_openid"))
+	page["total"] = len(openIds)
+	context.JSON(http.StatusOK, page)
+}
+
+//从nextOpenId之后取一页，与微信相同，next_openid为本页最后一个openid，没有更多时count为0且没有data
+func (server *Server) openIdPage(openIds []string, nextOpenId string) gin.H {
+	start := 0
+	if nextOpenId != "" {
+		start = sort.SearchStrings(openIds, nextOpenId)
+		if start < len(openIds) && openIds[start] == nextOpenId {
+			start++
+		}
+	}
+	end := start + server.pageSize
+	if end > len(openIds) {
+		end = len(openIds)
+	}
+	if start >= end {
+		return gin.H{"count": 0, "next_openid": ""}
+	}
+	return gin.H{
+		"count":       end - start,
+		"data":        gin.H{"openid": openIds[start:end]},
+		"next_openid": openIds[end-1],
+	}
+}
+
+func (server *Server) listUserInfo(context *gin.Context) {
+	var request struct {
+		UserList []struct {
+			OpenId string `json:"openid"`
+		} `json:"user_list"`
+	}
+	if !bindJson(context, &request) {
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	userInfos := []gin.H{}
+	for i := range request.UserList {
+		user, ok := server.users[request.UserList[i].OpenId]
+		if !ok {
+			writeError(context, 40003, "invalid openid")
+			return
+		}
+		userInfos = append(userInfos, gin.H{
+			"subscribe":  1,
+			"openid":     user.OpenId,
+			"nickname":   user.Nickname,
+			"tagid_list": user.TagIdList,
+		})
+	}
+	context.JSON(http.StatusOK, gin.H{"user_info_list": userInfos})
+}
+
+func (server *Server) bindTagMembers(context *gin.Context) (*Tag, []*User, bool) {
+	var request struct {
+		TagId      int      `json:"tagid"`
+		OpenIdList []string `json:"openid_list"`
+	}
+	if !bindJson(context, &request) {
+		return nil, nil, false
+	}
+	tag, ok := server.tags[request.TagId]
+	if !ok {
+		writeError(context, 45159, "invalid tag id")
+		return nil, nil, false
+	}
+	var users []*User
+	for i := range request.OpenIdList {
+		user, ok := server.users[request.OpenIdList[i]]
+		if !ok {
+			writeError(context, 40003, "invalid openid")
+			return nil, nil, false
+		}
+		users = append(users, user)
+	}
+	return tag, users, true
+}
+
+func (server *Server) addTagToUser(context *gin.Context) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	tag, users, ok := server.bindTagMembers(context)
+	if !ok {
+		return
+	}
+	for i := range users {
+		if !containsTagId(users[i].TagIdList, tag.Id) {
+			users[i].TagIdList = append(users[i].TagIdList, tag.Id)
+			tag.Count++
+		}
+	}
+	writeOk(context)
+}
+
+func (server *Server) deleteTagFromUser(context *gin.Context) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	tag, users, ok := server.bindTagMembers(context)
+	if !ok {
+		return
+	}
+	for i := range users {
+		if containsTagId(users[i].TagIdList, tag.Id) {
+			users[i].TagIdList = removeTagId(users[i].TagIdList, tag.Id)
+			tag.Count--
+		}
+	}
+	writeOk(context)
+}
+
+func (server *Server) listOpenIdByTagId(context *gin.Context) {
+	var request struct {
+		TagId      int    `json:"tagid"`
+		NextOpenId string `json:"next_openid"`
+	}
+	if !bindJson(context, &request) {
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if _, ok := server.tags[request.TagId]; !ok {
+		writeError(context, 45159, "invalid tag id")
+		return
+	}
+	openIds := server.sortedOpenIds(func(user *User) bool { return containsTagId(user.TagIdList, request.TagId) })
+	context.JSON(http.StatusOK, server.openIdPage(openIds, request.NextOpenId))
+}
+
+func (server *Server) listAllTag(context *gin.Context) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	tags := []Tag{}
+	for _, tag := range server.tags {
+		tags = append(tags, *tag)
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Id < tags[j].Id })
+	context.JSON(http.StatusOK, gin.H{"tags": tags})
+}
+
+func (server *Server) createTag(context *gin.Context) {
+	var request struct {
+		Tag struct {
+			Name string `json:"name"`
+		} `json:"tag"`
+	}
+	if !bindJson(context, &request) {
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if request.Tag.Name == "" {
+		writeError(context, 45158, "tag name too long")
+		return
+	}
+	for _, tag := range server.tags {
+		if tag.Name == request.Tag.Name {
+			writeError(context, 45157, "tag name duplicated")
+			return
+		}
+	}
+	tag := &Tag{Id: server.nextTagId, Name: request.Tag.Name}
+	server.nextTagId++
+	server.tags[tag.Id] = tag
+	context.JSON(http.StatusOK, gin.H{"tag": gin.H{"id": tag.Id, "name": tag.Name}})
+}
+
+func (server *Server) deleteTag(context *gin.Context) {
+	var request struct {
+		Tag struct {
+			Id int `json:"id"`
+		} `json:"tag"`
+	}
+	if !bindJson(context, &request) {
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if _, ok := server.tags[request.Tag.Id]; !ok {
+		writeError(context, 45159, "invalid tag id")
+		return
+	}
+	delete(server.tags, request.Tag.Id)
+	for _, user := range server.users {
+		user.TagIdList = removeTagId(user.TagIdList, request.Tag.Id)
+	}
+	writeOk(context)
+}
+
+func (server *Server) sendTemplate(context *gin.Context) {
+	var request SentTemplate
+	if !bindJson(context, &request) {
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if _, ok := server.users[request.ToUser]; !ok {
+		writeError(context, 40003, "invalid openid")
+		return
+	}
+	if !server.hasTemplate(request.TemplateId) {
+		writeError(context, 40037, "invalid template_id")
+		return
+	}
+	if server.unsubscribed[request.ToUser] {
+		writeError(context, 43004, "require subscribe")
+		return
+	}
+	if server.busy[request.ToUser] > 0 {
+		server.busy[request.ToUser]--
+		writeError(context, -1, "system error")
+		return
+	}
+	if server.templateRate > 0 {
+		slot := time.Now().Unix()
+		if slot != server.templateSlot {
+			server.templateSlot = slot
+			server.templateCount = 0
+		}
+		if server.templateCount >= server.templateRate {
+			server.templateThrottled++
+			writeError(context, 45009, "reach max api daily quota limit")
+			return
+		}
+		server.templateCount++
+	}
+	server.nextMsgId++
+	request.MsgId = server.nextMsgId
+	server.sent = append(server.sent, request)
+	context.JSON(http.StatusOK, gin.H{"errcode": 0, "errmsg": "ok", "msgid": request.MsgId})
+}
+
+func (server *Server) sendCustomMessage(context *gin.Context) {
+	var request map[string]interface{}
+	if !bindJson(context, &request) {
+		return
+	}
+	toUser, _ := request["touser"].(string)
+	msgType, _ := request["msgtype"].(string)
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if _, ok := server.users[toUser]; !ok {
+		writeError(context, 40003, "invalid openid")
+		return
+	}
+	if _, ok := request[msgType]; !ok {
+		writeError(context, 44002, "empty post data")
+		return
+	}
+	if server.expired[toUser] {
+		writeError(context, 45015, "response out of time limit or subscription is canceled")
+		return
+	}
+	server.sentCustom = append(server.sentCustom, SentCustomMessage{ToUser: toUser, MsgType: msgType, Message: request})
+	writeOk(context)
+}
+
+func (server *Server) sendTyping(context *gin.Context) {
+	var request struct {
+		ToUser  string `json:"touser"`
+		Command string `json:"command"`
+	}
+	if !bindJson(context, &request) {
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if _, ok := server.users[request.ToUser]; !ok {
+		writeError(context, 40003, "invalid openid")
+		return
+	}
+	if request.Command != "Typing" && request.Command != "CancelTyping" {
+		writeError(context, 47001, "data format error")
+		return
+	}
+	if server.expired[request.ToUser] {
+		writeError(context, 45015, "response out of time limit or subscription is canceled")
+		return
+	}
+	writeOk(context)
+}
+
+//群发立即视为发送成功
+func (server *Server) sendMass(context *gin.Context) {
+	var request map[string]interface{}
+	if !bindJson(context, &request) {
+		return
+	}
+	msgType, _ := request["msgtype"].(string)
+	if msgType == "image" {
+		msgType = "images"
+	}
+	if _, ok := request[msgType]; !ok {
+		writeError(context, 44002, "empty post data")
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.nextMsgId++
+	server.masses[server.nextMsgId] = "SEND_SUCCESS"
+	context.JSON(http.StatusOK, gin.H{"errcode": 0, "errmsg": "send job submission success", "msg_id": server.nextMsgId, "msg_data_id": server.nextMsgId})
+}
+
+func (server *Server) previewMass(context *gin.Context) {
+	var request map[string]interface{}
+	if !bindJson(context, &request) {
+		return
+	}
+	toUser, _ := request["touser"].(string)
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if _, ok := server.users[toUser]; !ok {
+		writeError(context, 40003, "invalid openid")
+		return
+	}
+	server.nextMsgId++
+	context.JSON(http.StatusOK, gin.H{"errcode": 0, "errmsg": "preview success", "msg_id": server.nextMsgId})
+}
+
+func (server *Server) getMass(context *gin.Context) {
+	var request struct {
+		MsgId int64 `json:"msg_id"`
+	}
+	if !bindJson(context, &request) {
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	status, ok := server.masses[request.MsgId]
+	if !ok {
+		writeError(context, 47001, "data format error")
+		return
+	}
+	context.JSON(http.StatusOK, gin.H{"msg_id": request.MsgId, "msg_status": status})
+}
+
+func (server *Server) deleteMass(context *gin.Context) {
+	var request struct {
+		MsgId int64 `json:"msg_id"`
+	}
+	if !bindJson(context, &request) {
+		return
+	}
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if _, ok := server.masses[request.MsgId]; !ok {
+		writeError(context, 47001, "data format error")
+		return
+	}
+	server.masses[request.MsgId] = "DELETE"
+	writeOk(context)
+}
+
+func (server *Server) hasTemplate(templateId string) bool {
+	for i := range server.templates {
+		if server.templates[i].TemplateId == templateId {
+			return true
+		}
+	}
+	return false
+}
+
+func containsTagId(tagIds []int, tagId int) bool {
+	for i := range tagIds {
+		if tagIds[i] == tagId {
+			return true
+		}
+	}
+	return false
+}
+
+func removeTagId(tagIds []int, tagId int) []int {
+	result := []int{}
+	for i := range tagIds {
+		if tagIds[i] != tagId {
+			result = append(result, tagIds[i])
+		}
+	}
+	return result
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"wxGateway/wechat"
+)
+
+//规则的匹配方式
+const (
+	RuleMatchExact   = "exact"
+	RuleMatchPrefix  = "prefix"
+	RuleMatchRegex   = "regex"
+	RuleMatchDefault = "default"
+)
+
+//关键词自动回复规则，Reply的格式与同步webhook的响应相同
+type Rule struct {
+	Id      string          `json:"id"`
+	Match   string          `json:"match"`
+	Keyword string          `json:"keyword"`
+	Reply   json.RawMessage `json:"reply"`
+	regexp  *regexp.Regexp
+	reply   wechat.Reply
+}
+
+//校验规则并预先编译正则和解析回复
+func (rule *Rule) compile() error {
+	switch rule.Match {
+	case RuleMatchExact, RuleMatchPrefix:
+		if rule.Keyword == "" {
+			return errors.New("规则的keyword为空")
+		}
+	case RuleMatchRegex:
+		compiled, err := regexp.Compile(rule.Keyword)
+		if err != nil {
+			return err
+		}
+		rule.regexp = compiled
+	case RuleMatchDefault:
+	default:
+		return errors.New("规则的match非法: " + rule.Match)
+	}
+	reply, err := wechat.UnmarshalReply(rule.Reply)
+	if err != nil {
+		return err
+	}
+	rule.reply = reply
+	return nil
+}
+
+func (rule *Rule) match(content string) bool {
+	switch rule.Match {
+	case RuleMatchExact:
+		return content == rule.Keyword
+	case RuleMatchPrefix:
+		return strings.HasPrefix(content, rule.Keyword)
+	case RuleMatchRegex:
+		return rule.regexp.MatchString(content)
+	default:
+		return false
+	}
+}
+
+//规则持久化在json文件中，文件被外部修改后按修改时间热加载
+type ruleManager struct {
+	path    string
+	mutex   sync.Mutex
+	rules   []*Rule
+	modTime time.Time
+}
+
+var rules *ruleManager
+
+func newRuleManager(path string) *ruleManager {
+	return &ruleManager{path: path}
+}
+
+//文件修改时间变化时重新加载，文件不存在时视为没有规则
+func (manager *ruleManager) load() error {
+	info, err := os.Stat(manager.path)
+	if os.IsNotExist(err) {
+		manager.rules = nil
+		manager.modTime = time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(manager.modTime) {
+		return nil
+	}
+	data, err := ioutil.ReadFile(manager.path)
+	if err != nil {
+		return err
+	}
+	var list []*Rule
+	if len(strings.TrimSpace(string(data))) > 0 {
+		err = json.Unmarshal(data, &list)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range list {
+		err = list[i].compile()
+		if err != nil {
+			return errors.New("规则" + list[i].Id + "非法: " + err.Error())
+		}
+	}
+	manager.rules = list
+	manager.modTime = info.ModTime()
+	log.WithFields(logrus.Fields{"path": manager.path, "rules": len(list)}).Info("加载自动回复规则")
+	return nil
+}
+
+//先写临时文件再rename，避免读到写了一半的文件
+func (manager *ruleManager) save(list []*Rule) error {
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(manager.path), filepath.Base(manager.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = temp.Write(data)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	err = os.Rename(temp.Name(), manager.path)
+	if err != nil {
+		os.Remove(temp.Name())
+		return err
+	}
+	manager.rules = list
+	manager.modTime = time.Time{}
+	if info, err := os.Stat(manager.path); err == nil {
+		manager.modTime = info.ModTime()
+	}
+	return nil
+}
+
+//加载失败时同时返回上一次成功加载的规则
+func (manager *ruleManager) list() ([]*Rule, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	err := manager.load()
+	return manager.rules, err
+}
+
+//id为空时新增，否则替换同id的规则
+func (manager *ruleManager) saveRule(rule Rule) (Rule, error) {
+	err := rule.compile()
+	if err != nil {
+		return rule, err
+	}
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	err = manager.load()
+	if err != nil {
+		return rule, err
+	}
+	list := make([]*Rule, 0, len(manager.rules)+1)
+	replaced := false
+	for i := range manager.rules {
+		if rule.Id != "" && manager.rules[i].Id == rule.Id {
+			list = append(list, &rule)
+			replaced = true
+		} else {
+			list = append(list, manager.rules[i])
+		}
+	}
+	if !replaced {
+		if rule.Id == "" {
+			rule.Id = strconv.FormatInt(time.Now().UnixNano(), 36)
+		}
+		list = append(list, &rule)
+	}
+	return rule, manager.save(list)
+}
+
+func (manager *ruleManager) deleteRule(id string) (bool, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	err := manager.load()
+	if err != nil {
+		return false, err
+	}
+	list := make([]*Rule, 0, len(manager.rules))
+	for i := range manager.rules {
+		if manager.rules[i].Id != id {
+			list = append(list, manager.rules[i])
+		}
+	}
+	if len(list) == len(manager.rules) {
+		return false, errors.New("规则不存在: " + id)
+	}
+	return true, manager.save(list)
+}
+
+//按规则顺序匹配文本消息，都不匹配时使用第一条default规则
+func (manager *ruleManager) matchReply(message *wechat.Message) wechat.Reply {
+	if message.MsgType != wechat.MsgTypeText {
+		return nil
+	}
+	list, err := manager.list()
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("加载自动回复规则失败，继续使用旧规则")
+	}
+	var defaultRule *Rule
+	for i := range list {
+		if list[i].Match == RuleMatchDefault {
+			if defaultRule == nil {
+				defaultRule = list[i]
+			}
+			continue
+		}
+		if list[i].match(message.Content) {
+			log.WithFields(logrus.Fields{"rule": list[i].Id, "content": message.Content}).Info("命中自动回复规则")
+			return list[i].reply
+		}
+	}
+	if defaultRule != nil {
+		log.WithFields(logrus.Fields{"rule": defaultRule.Id, "content": message.Content}).Info("使用默认自动回复规则")
+		return defaultRule.reply
+	}
+	return nil
+}
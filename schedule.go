@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/robfig/cron/v3"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"sort"
+	"sync"
+	"time"
+)
+
+//定时发送状态
+const (
+	ScheduleStatusActive   = "active"
+	ScheduleStatusDone     = "done"
+	ScheduleStatusCanceled = "canceled"
+)
+
+var schedulesBucket = []byte("schedules")
+
+//定时发送模板消息，SendTime为一次性发送的秒级时间戳，Cron为周期发送的cron表达式，二选一
+//收件人与/api/sendTemplate相同，到时间后创建一个发送任务，去重后发送
+type Schedule struct {
+	Id         string            `json:"id"`
+	Status     string            `json:"status"`
+	TemplateId string            `json:"templateId"`
+	Url        string            `json:"url"`
+	Data       map[string]string `json:"data"`
+	JobRecipients
+	SendTime   int64  `json:"sendTime,omitempty"`
+	Cron       string `json:"cron,omitempty"`
+	CreateTime int64  `json:"createTime"`
+	NextTime   int64  `json:"nextTime,omitempty"`
+	LastTime   int64  `json:"lastTime,omitempty"`
+	LastJobId  string `json:"lastJobId,omitempty"`
+}
+
+func (schedule *Schedule) validate() error {
+	if schedule.TemplateId == "" {
+		return errors.New("定时发送的templateId为空")
+	}
+	if err := schedule.JobRecipients.validate(); err != nil {
+		return errors.New("定时发送的" + err.Error())
+	}
+	if (schedule.SendTime > 0) == (schedule.Cron != "") {
+		return errors.New("定时发送的sendTime和cron必须且只能设置一个")
+	}
+	if schedule.Cron != "" {
+		if _, err := cron.ParseStandard(schedule.Cron); err != nil {
+			return errors.New("cron表达式非法: " + err.Error())
+		}
+	}
+	return nil
+}
+
+//计算after之后的下次发送时间，一次性发送发过之后没有下次
+func (schedule *Schedule) next(after time.Time) int64 {
+	if schedule.Cron == "" {
+		if schedule.LastTime > 0 {
+			return 0
+		}
+		return schedule.SendTime
+	}
+	cronSchedule, err := cron.ParseStandard(schedule.Cron)
+	if err != nil {
+		return 0
+	}
+	return cronSchedule.Next(after).Unix()
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//保存在bbolt中的定时发送，内存中保留一份供调度使用
+type scheduleStore struct {
+	db        *bolt.DB
+	mutex     sync.Mutex
+	schedules map[string]*Schedule
+	//新增或取消定时发送时唤醒调度循环
+	wake chan struct{}
+}
+
+var schedules *scheduleStore
+
+func newScheduleStore(db *bolt.DB) (*scheduleStore, error) {
+	store := &scheduleStore{db: db, schedules: map[string]*Schedule{}, wake: make(chan struct{}, 1)}
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(schedulesBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			var schedule Schedule
+			err := json.Unmarshal(value, &schedule)
+			if err != nil {
+				return err
+			}
+			store.schedules[schedule.Id] = &schedule
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *scheduleStore) put(schedule *Schedule) error {
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return err
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(schedulesBucket).Put([]byte(schedule.Id), data)
+	})
+}
+
+func (store *scheduleStore) notify() {
+	select {
+	case store.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (store *scheduleStore) add(schedule Schedule) (*Schedule, error) {
+	err := schedule.validate()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	schedule.Id = newJobId()
+	schedule.Status = ScheduleStatusActive
+	schedule.CreateTime = now.Unix()
+	schedule.LastTime = 0
+	schedule.LastJobId = ""
+	schedule.NextTime = schedule.next(now)
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	err = store.put(&schedule)
+	if err != nil {
+		return nil, err
+	}
+	store.schedules[schedule.Id] = &schedule
+	store.notify()
+	log.WithFields(logrus.Fields{"schedule": schedule}).Info("创建定时发送")
+	copied := schedule
+	return &copied, nil
+}
+
+func (store *scheduleStore) get(id string) (*Schedule, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	schedule, ok := store.schedules[id]
+	if !ok {
+		return nil, errors.New("定时发送不存在: " + id)
+	}
+	copied := *schedule
+	return &copied, nil
+}
+
+//按创建时间倒序
+func (store *scheduleStore) list() []Schedule {
+	store.mutex.Lock()
+	list := make([]Schedule, 0, len(store.schedules))
+	for _, schedule := range store.schedules {
+		list = append(list, *schedule)
+	}
+	store.mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreateTime > list[j].CreateTime
+	})
+	return list
+}
+
+//取消定时发送，已经创建的任务用/api/jobs/:id/cancel取消
+func (store *scheduleStore) cancel(id string) (*Schedule, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	schedule, ok := store.schedules[id]
+	if !ok {
+		return nil, errors.New("定时发送不存在: " + id)
+	}
+	if schedule.Status != ScheduleStatusActive {
+		return nil, errors.New("定时发送已结束: " + id)
+	}
+	canceled := *schedule
+	canceled.Status = ScheduleStatusCanceled
+	canceled.NextTime = 0
+	err := store.put(&canceled)
+	if err != nil {
+		return nil, err
+	}
+	*schedule = canceled
+	store.notify()
+	log.WithFields(logrus.Fields{"id": id}).Info("取消定时发送")
+	return &canceled, nil
+}
+
+//调度循环，睡到最近一个定时发送的时间，停机期间错过的定时发送启动后补发一次
+func (store *scheduleStore) run(ctx context.Context) {
+	for {
+		wait := store.fireDue(time.Now())
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-store.wake:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+//为到期的定时发送创建任务，返回距离下一个定时发送的时间
+func (store *scheduleStore) fireDue(now time.Time) time.Duration {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	wait := time.Hour
+	for _, schedule := range store.schedules {
+		if schedule.Status != ScheduleStatusActive {
+			continue
+		}
+		if schedule.NextTime <= now.Unix() {
+			store.fire(schedule, now)
+		}
+		if schedule.Status == ScheduleStatusActive {
+			if until := time.Until(time.Unix(schedule.NextTime, 0)); until < wait {
+				wait = until
+			}
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+func (store *scheduleStore) fire(schedule *Schedule, now time.Time) {
+	job := sendScheduledTemplate(schedule)
+	schedule.LastTime = now.Unix()
+	schedule.LastJobId = job.Id
+	schedule.NextTime = schedule.next(now)
+	if schedule.NextTime == 0 {
+		schedule.Status = ScheduleStatusDone
+	}
+	err := store.put(schedule)
+	if err != nil {
+		log.WithFields(logrus.Fields{"id": schedule.Id, "err": err}).Error("保存定时发送失败")
+	}
+	log.WithFields(logrus.Fields{"id": schedule.Id, "jobId": job.Id, "nextTime": schedule.NextTime}).Info("定时发送创建任务")
+}
+
+func sendScheduledTemplate(schedule *Schedule) *Job {
+	recipients := schedule.JobRecipients
+	job := newTemplateJob(schedule.TemplateId, schedule.Url, schedule.Data, recipients.target())
+	job.ScheduleId = schedule.Id
+	return jobs.start(job, recipients.list)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+	"wxGateway/wechat"
+)
+
+//把微信推送的消息和事件转发给下游服务
+type Webhook struct {
+	Url string `json:"url"`
+	//非空时用HMAC-SHA256对"timestamp.body"签名，放在X-Signature请求头，格式见signWebhook
+	Secret string `json:"secret"`
+	//只转发这些MsgType，为空时转发全部
+	MsgTypes []string `json:"msgTypes"`
+	//MsgType为event时只转发这些Event，为空时转发全部
+	Events []string `json:"events"`
+	//失败重试次数，重试间隔指数增长，同步webhook不重试
+	Retry int `json:"retry"`
+	//同步webhook的响应作为给用户的被动回复，响应{"MsgType":"success"}时不回复也不再匹配自动回复规则
+	Sync bool `json:"sync"`
+}
+
+//同步webhook超过callbackReplyTimeout才返回时，回复改用客服消息发送，最多等待syncWebhookTimeout
+var syncWebhookTimeout = 30 * time.Second
+
+//异步webhook每次投递的超时时间
+var webhookTimeout = 10 * time.Second
+
+//不设置Timeout，超时由每个请求的ctx决定，同步和异步的超时时间不同
+var webhookHttpClient = &http.Client{}
+
+//WEBHOOKS环境变量为Webhook的json数组
+func parseWebhooks(webhooksString string) ([]Webhook, error) {
+	if webhooksString == "" {
+		return nil, nil
+	}
+	var webhooks []Webhook
+	err := json.Unmarshal([]byte(webhooksString), &webhooks)
+	if err != nil {
+		return nil, err
+	}
+	for i := range webhooks {
+		if webhooks[i].Url == "" {
+			return nil, errors.New("webhook的url为空")
+		}
+	}
+	return webhooks, nil
+}
+
+func (webhook Webhook) match(message *wechat.Message) bool {
+	if len(webhook.MsgTypes) > 0 && !containsString(webhook.MsgTypes, message.MsgType) {
+		return false
+	}
+	if message.MsgType == wechat.MsgTypeEvent && len(webhook.Events) > 0 && !containsString(webhook.Events, message.Event) {
+		return false
+	}
+	return true
+}
+
+func containsString(values []string, value string) bool {
+	for i := range values {
+		if values[i] == value {
+			return true
+		}
+	}
+	return false
+}
+
+//转发消息给所有匹配的webhook，异步webhook在后台投递，返回第一个同步webhook给出的被动回复
+func relayWebhooks(ctx context.Context, message *wechat.Message) wechat.Reply {
+	body, err := json.Marshal(message)
+	if err != nil {
+		log.WithFields(logrus.Fields{"err": err}).Error("序列化webhook消息失败")
+		return nil
+	}
+	var reply wechat.Reply
+	for i := range webhooks {
+		if !webhooks[i].match(message) {
+			continue
+		}
+		if !webhooks[i].Sync {
+			go webhooks[i].deliver(body)
+			continue
+		}
+		if reply != nil {
+			go webhooks[i].post(context.Background(), body)
+			continue
+		}
+		reply = webhooks[i].call(ctx, body)
+	}
+	return reply
+}
+
+//异步投递，失败后按1s、2s、4s...退避重试
+func (webhook Webhook) deliver(body []byte) {
+	for i := 0; i <= webhook.Retry; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(1<<uint(i-1)) * time.Second)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+		_, err := webhook.post(ctx, body)
+		cancel()
+		if err == nil {
+			return
+		}
+		log.WithFields(logrus.Fields{"url": webhook.Url, "retry": i, "err": err}).Warn("投递webhook失败")
+	}
+	log.WithFields(logrus.Fields{"url": webhook.Url, "body": string(body)}).Error("投递webhook重试耗尽")
+}
+
+//同步调用，响应体为空时不回复
+func (webhook Webhook) call(ctx context.Context, body []byte) wechat.Reply {
+	ctx, cancel := context.WithTimeout(ctx, syncWebhookTimeout)
+	defer cancel()
+	response, err := webhook.post(ctx, body)
+	if err != nil {
+		log.WithFields(logrus.Fields{"url": webhook.Url, "err": err}).Error("调用同步webhook失败")
+		return nil
+	}
+	if len(bytes.TrimSpace(response)) == 0 {
+		return nil
+	}
+	reply, err := wechat.UnmarshalReply(response)
+	if err != nil {
+		log.WithFields(logrus.Fields{"url": webhook.Url, "response": string(response), "err": err}).Error("解析同步webhook回复失败")
+		return nil
+	}
+	return reply
+}
+
+func (webhook Webhook) post(ctx context.Context, body []byte) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	request.Header.Set("Content-Type", "application/json;CHARSET=utf-8")
+	request.Header.Set("X-Timestamp", timestamp)
+	if webhook.Secret != "" {
+		request.Header.Set("X-Signature", signWebhook(webhook.Secret, timestamp, body))
+	}
+	response, err := webhookHttpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	log.WithFields(logrus.Fields{"url": webhook.Url, "StatusCode": response.StatusCode, "body": string(data)}).Info("webhook响应")
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, errors.New("webhook响应码异常: " + strconv.Itoa(response.StatusCode))
+	}
+	return data, nil
+}
+
+//X-Signature请求头为"sha256="加上hex(HMAC-SHA256(secret, X-Timestamp + "." + body))，
+//下游用同样的方法计算后与整个请求头比较
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,60 @@
+package wechat
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+)
+
+//响应json带有非0的errcode时返回对应的微信错误
+func (client *Client) analysisError(name string, jsonString string) error {
+	errcode := gjson.Get(jsonString, "errcode")
+	if !errcode.Exists() || errcode.Int() == ErrCodeOk {
+		return nil
+	}
+	err := &WeChatError{Api: name, ErrCode: int(errcode.Int()), ErrMsg: gjson.Get(jsonString, "errmsg").String()}
+	client.log.WithFields(logrus.Fields{"errcode": err.ErrCode, "errmsg": err.ErrMsg}).Error(name + "失败")
+	return err
+}
+
+//解析只返回errcode的接口响应
+func (client *Client) analysisSuccess(name string, jsonString string) (bool, error) {
+	if !gjson.Valid(jsonString) {
+		client.log.Error(name + "响应json非法")
+		return false, errors.New(name + "响应json非法")
+	}
+	if err := client.analysisError(name, jsonString); err != nil {
+		return false, err
+	}
+	result := gjson.Get(jsonString, "errcode")
+	success := result.Exists()
+	client.log.WithFields(logrus.Fields{"success": success}).Info(name + "结果")
+	if !success {
+		return false, errors.New(name + "响应json没有errcode属性")
+	}
+	return success, nil
+}
+
+//把响应json中path下的属性反序列化到object
+func (client *Client) analysisObject(name string, jsonString string, path string, object interface{}) error {
+	if !gjson.Valid(jsonString) {
+		client.log.Error(name + "响应json非法")
+		return errors.New(name + "响应json非法")
+	}
+	if err := client.analysisError(name, jsonString); err != nil {
+		return err
+	}
+	result := gjson.Get(jsonString, path)
+	if !result.Exists() {
+		client.log.Error(name + "响应json没有" + path + "属性")
+		return errors.New(name + "响应json没有" + path + "属性")
+	}
+	err := json.Unmarshal([]byte(result.Raw), object)
+	if err != nil {
+		client.log.WithFields(logrus.Fields{"err": err}).Error("反序列化" + name + "响应json失败")
+	} else {
+		client.log.WithFields(logrus.Fields{path: object}).Info(name + "成功")
+	}
+	return err
+}
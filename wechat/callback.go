@@ -0,0 +1,89 @@
+package wechat
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/xml"
+	"sort"
+	"strings"
+)
+
+//用户发给公众号的消息和事件推送，不同MsgType/Event只会填充其中一部分字段
+type Message struct {
+	XMLName      xml.Name `xml:"xml" json:"-"`
+	ToUserName   string   `xml:"ToUserName" json:"ToUserName"`
+	FromUserName string   `xml:"FromUserName" json:"FromUserName"`
+	CreateTime   int64    `xml:"CreateTime" json:"CreateTime"`
+	MsgType      string   `xml:"MsgType" json:"MsgType"`
+	MsgId        int64    `xml:"MsgId,omitempty" json:"MsgId,omitempty"`
+
+	//文本消息
+	Content string `xml:"Content,omitempty" json:"Content,omitempty"`
+	//图片、语音、视频消息
+	PicUrl       string `xml:"PicUrl,omitempty" json:"PicUrl,omitempty"`
+	MediaId      string `xml:"MediaId,omitempty" json:"MediaId,omitempty"`
+	Format       string `xml:"Format,omitempty" json:"Format,omitempty"`
+	Recognition  string `xml:"Recognition,omitempty" json:"Recognition,omitempty"`
+	ThumbMediaId string `xml:"ThumbMediaId,omitempty" json:"ThumbMediaId,omitempty"`
+	//地理位置消息
+	LocationX float64 `xml:"Location_X,omitempty" json:"Location_X,omitempty"`
+	LocationY float64 `xml:"Location_Y,omitempty" json:"Location_Y,omitempty"`
+	Scale     int     `xml:"Scale,omitempty" json:"Scale,omitempty"`
+	Label     string  `xml:"Label,omitempty" json:"Label,omitempty"`
+	//链接消息
+	Title       string `xml:"Title,omitempty" json:"Title,omitempty"`
+	Description string `xml:"Description,omitempty" json:"Description,omitempty"`
+	Url         string `xml:"Url,omitempty" json:"Url,omitempty"`
+
+	//事件推送
+	Event     string  `xml:"Event,omitempty" json:"Event,omitempty"`
+	EventKey  string  `xml:"EventKey,omitempty" json:"EventKey,omitempty"`
+	Ticket    string  `xml:"Ticket,omitempty" json:"Ticket,omitempty"`
+	Latitude  float64 `xml:"Latitude,omitempty" json:"Latitude,omitempty"`
+	Longitude float64 `xml:"Longitude,omitempty" json:"Longitude,omitempty"`
+	Precision float64 `xml:"Precision,omitempty" json:"Precision,omitempty"`
+	//模板消息、群发消息发送结果事件的消息id，注意与普通消息的MsgId大小写不同
+	MsgID  int64  `xml:"MsgID,omitempty" json:"MsgID,omitempty"`
+	Status string `xml:"Status,omitempty" json:"Status,omitempty"`
+	//群发消息发送结果事件的统计
+	TotalCount  int `xml:"TotalCount,omitempty" json:"TotalCount,omitempty"`
+	FilterCount int `xml:"FilterCount,omitempty" json:"FilterCount,omitempty"`
+	SentCount   int `xml:"SentCount,omitempty" json:"SentCount,omitempty"`
+	ErrorCount  int `xml:"ErrorCount,omitempty" json:"ErrorCount,omitempty"`
+}
+
+//消息类型
+const (
+	MsgTypeText       = "text"
+	MsgTypeImage      = "image"
+	MsgTypeVoice      = "voice"
+	MsgTypeVideo      = "video"
+	MsgTypeShortVideo = "shortvideo"
+	MsgTypeLocation   = "location"
+	MsgTypeLink       = "link"
+	MsgTypeEvent      = "event"
+)
+
+//解析微信推送的xml消息
+func ParseMessage(data []byte) (*Message, error) {
+	var message Message
+	err := xml.Unmarshal(data, &message)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+//校验微信服务器的请求签名，signature为token、timestamp、nonce字典序排序后拼接的sha1
+func CheckSignature(token string, signature string, timestamp string, nonce string) bool {
+	return subtle.ConstantTimeCompare([]byte(Signature(token, timestamp, nonce)), []byte(signature)) == 1
+}
+
+//计算签名，参数字典序排序后拼接再sha1
+func Signature(values ...string) string {
+	sorted := append([]string(nil), values...)
+	sort.Strings(sorted)
+	sum := sha1.Sum([]byte(strings.Join(sorted, "")))
+	return hex.EncodeToString(sum[:])
+}
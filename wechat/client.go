@@ -0,0 +1,206 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const DefaultApiUrl = "https://api.weixin.qq.com"
+const DefaultTimeout = 5 * time.Second
+const DefaultRetry = 3
+
+//网络异常时第一次重试的间隔
+const retryBaseInterval = 200 * time.Millisecond
+
+type Config struct {
+	AppId     string
+	AppSecret string
+	//微信接口地址，默认为DefaultApiUrl
+	ApiUrl string
+	//单次请求超时时间，默认为DefaultTimeout
+	Timeout time.Duration
+	//请求失败重试次数，默认为DefaultRetry
+	Retry int
+	//为空时使用Timeout创建
+	HttpClient *http.Client
+	//为空时使用logrus.New()
+	Logger *logrus.Logger
+	//accessToken提前刷新的时间，默认为DefaultTokenRefreshAhead
+	TokenRefreshAhead time.Duration
+	//accessToken获取方式，默认为TokenModeCredential
+	TokenMode string
+	//TokenModeShared时网关的/api/accessToken地址和鉴权token
+	TokenProviderUrl   string
+	TokenProviderToken string
+	//accessToken存储，默认为进程内存储，多副本部署时使用FileTokenStore或RedisTokenStore
+	TokenStore TokenStore
+}
+
+//微信公众号接口客户端，持有自己的凭证、accessToken缓存和重试策略，可被多个goroutine共用
+type Client struct {
+	appId      string
+	appSecret  string
+	apiUrl     string
+	retry      int
+	httpClient *http.Client
+	log        *logrus.Logger
+
+	tokenMode          string
+	tokenProviderUrl   string
+	tokenProviderToken string
+	tokenManager       *tokenManager
+}
+
+func NewClient(config Config) *Client {
+	client := &Client{
+		appId:      config.AppId,
+		appSecret:  config.AppSecret,
+		apiUrl:     strings.TrimRight(config.ApiUrl, "/"),
+		retry:      config.Retry,
+		httpClient: config.HttpClient,
+		log:        config.Logger,
+
+		tokenMode:          config.TokenMode,
+		tokenProviderUrl:   config.TokenProviderUrl,
+		tokenProviderToken: config.TokenProviderToken,
+	}
+	if client.apiUrl == "" {
+		client.apiUrl = DefaultApiUrl
+	}
+	if client.tokenMode == "" {
+		client.tokenMode = TokenModeCredential
+	}
+	if client.retry <= 0 {
+		client.retry = DefaultRetry
+	}
+	if client.httpClient == nil {
+		timeout := config.Timeout
+		if timeout <= 0 {
+			timeout = DefaultTimeout
+		}
+		client.httpClient = &http.Client{Timeout: timeout}
+	}
+	if client.log == nil {
+		client.log = logrus.New()
+	}
+	client.tokenManager = newTokenManager(client, config.TokenRefreshAhead, config.TokenStore)
+	return client
+}
+
+func (client *Client) AppId() string {
+	return client.appId
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//调用需要accessToken的接口，网络异常和5xx时重试，accessToken失效时刷新后重试
+func (client *Client) call(ctx context.Context, name string, method string, path string, body interface{}) (string, error) {
+	return client.invoke(ctx, name, method, path, body, true)
+}
+
+//调用发送消息等不幂等的接口，网络异常时微信可能已经发出，不重试，由调用方决定是否重发
+//accessToken失效时微信没有发送，仍然刷新后重试
+func (client *Client) callOnce(ctx context.Context, name string, method string, path string, body interface{}) (string, error) {
+	return client.invoke(ctx, name, method, path, body, false)
+}
+
+func (client *Client) invoke(ctx context.Context, name string, method string, path string, body interface{}, retryRequest bool) (string, error) {
+	var err error
+	for i := 0; i < client.retry; i++ {
+		var token Token
+		token, err = client.AccessToken(ctx)
+		if err != nil {
+			return "", err
+		}
+		var jsonString string
+		jsonString, err = client.request(ctx, name, method, path, url.Values{"access_token": {token.AccessToken}}, body)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			if !retryRequest || !IsRetryable(err) {
+				return "", err
+			}
+			if i+1 < client.retry {
+				select {
+				case <-ctx.Done():
+					return "", ctx.Err()
+				case <-time.After(retryInterval(i)):
+				}
+			}
+			continue
+		}
+		errcode := gjson.Get(jsonString, "errcode").Int()
+		if !isTokenErrCode(int(errcode)) {
+			return jsonString, nil
+		}
+		client.log.WithFields(logrus.Fields{"errcode": errcode}).Warn(name + "accessToken失效")
+		client.tokenManager.refresh(ctx, token.AccessToken)
+		err = client.analysisError(name, jsonString)
+	}
+	return "", err
+}
+
+//网络异常时重试的间隔，从retryBaseInterval开始翻倍，加上随机抖动避免同时重试
+func retryInterval(attempt int) time.Duration {
+	interval := retryBaseInterval << uint(attempt)
+	return interval/2 + time.Duration(rand.Int63n(int64(interval/2)+1))
+}
+
+func (client *Client) request(ctx context.Context, name string, method string, path string, params url.Values, body interface{}) (string, error) {
+	statusCode, jsonString, err := client.send(ctx, method, path, params, body)
+	client.log.WithFields(logrus.Fields{"err": err}).Info(name + "请求")
+	if err != nil {
+		return "", &RequestError{Api: name, Err: err}
+	}
+	client.log.WithFields(logrus.Fields{"StatusCode": statusCode, "body": jsonString}).Info(name + "请求")
+	if statusCode != http.StatusOK {
+		return "", &RequestError{Api: name, StatusCode: statusCode}
+	}
+	return jsonString, nil
+}
+
+func (client *Client) send(ctx context.Context, method string, path string, params url.Values, body interface{}) (int, string, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return 0, "", err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+	//path可以自带查询参数
+	separator := "?"
+	if strings.Contains(path, "?") {
+		separator = "&"
+	}
+	request, err := http.NewRequest(method, client.apiUrl+path+separator+params.Encode(), reader)
+	if err != nil {
+		return 0, "", err
+	}
+	request = request.WithContext(ctx)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json;CHARSET=utf-8")
+	}
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return 0, "", err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return 0, "", err
+	}
+	return response.StatusCode, string(data), nil
+}
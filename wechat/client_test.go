@@ -0,0 +1,74 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{&RequestError{Api: "接口", Err: errors.New("connection reset")}, true},
+		{&RequestError{Api: "接口", StatusCode: http.StatusBadGateway}, true},
+		{&RequestError{Api: "接口", StatusCode: http.StatusNotFound}, false},
+		{&WeChatError{Api: "接口", ErrCode: ErrCodeSystemBusy}, true},
+		{&WeChatError{Api: "接口", ErrCode: ErrCodeApiFreqOutOfLimit}, true},
+		{&WeChatError{Api: "接口", ErrCode: ErrCodeRequireSubscribe}, false},
+		{errors.New("其他错误"), false},
+	}
+	for _, test := range tests {
+		if retryable := IsRetryable(test.err); retryable != test.retryable {
+			t.Errorf("%v 可重试为%v，期望%v", test.err, retryable, test.retryable)
+		}
+	}
+}
+
+func TestRequestErrorUnwrap(t *testing.T) {
+	cause := errors.New("connection reset")
+	err := &RequestError{Api: "接口", Err: cause}
+	if err.Unwrap() != cause {
+		t.Fatalf("没有保留原因: %v", err.Unwrap())
+	}
+	if err.Error() != "接口请求异常: connection reset" {
+		t.Fatalf("错误信息为 %s", err.Error())
+	}
+}
+
+//发送模板消息不幂等，5xx时只请求一次，由调用方决定是否重发；查询接口重试
+func TestSendTemplateNotRetried(t *testing.T) {
+	var sends, gets int32
+	httpServer := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		switch request.URL.Path {
+		case "/cgi-bin/token":
+			writer.Write([]byte(`{"access_token":"token","expires_in":7200}`))
+		case "/cgi-bin/message/template/send":
+			atomic.AddInt32(&sends, 1)
+			writer.WriteHeader(http.StatusBadGateway)
+		default:
+			atomic.AddInt32(&gets, 1)
+			writer.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer httpServer.Close()
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	client := NewClient(Config{AppId: "appId", AppSecret: "appSecret", ApiUrl: httpServer.URL, Retry: 3, Logger: logger})
+	ctx := context.Background()
+
+	_, err := client.SendTemplate(ctx, "openId", "template", "", map[string]interface{}{})
+	if sent := atomic.LoadInt32(&sends); !IsRetryable(err) || sent != 1 {
+		t.Fatalf("发送模板消息请求了%d次，错误为%v", sent, err)
+	}
+	_, err = client.ListTemplates(ctx)
+	if got := atomic.LoadInt32(&gets); !IsRetryable(err) || got != 3 {
+		t.Fatalf("获取模板请求了%d次，错误为%v", got, err)
+	}
+}
@@ -0,0 +1,132 @@
+package wechat
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+)
+
+//安全模式下的消息加解密，即微信文档中的WXBizMsgCrypt方案：
+//AES-256-CBC，密钥为EncodingAESKey补"="后base64解码，iv为密钥前16字节，
+//明文为16字节随机串+4字节网络序消息长度+消息+appId，PKCS#7按32字节补位
+type MsgCrypt struct {
+	token  string
+	appId  string
+	aesKey []byte
+}
+
+//加密消息的xml外壳
+type encryptedMessage struct {
+	XMLName      xml.Name `xml:"xml"`
+	ToUserName   string   `xml:"ToUserName,omitempty"`
+	Encrypt      cdata    `xml:"Encrypt"`
+	MsgSignature cdata    `xml:"MsgSignature,omitempty"`
+	TimeStamp    string   `xml:"TimeStamp,omitempty"`
+	Nonce        cdata    `xml:"Nonce,omitempty"`
+}
+
+const blockSize = 32
+
+func NewMsgCrypt(token string, encodingAesKey string, appId string) (*MsgCrypt, error) {
+	if len(encodingAesKey) != 43 {
+		return nil, errors.New("EncodingAESKey长度必须为43")
+	}
+	aesKey, err := base64.StdEncoding.DecodeString(encodingAesKey + "=")
+	if err != nil {
+		return nil, errors.New("EncodingAESKey非法")
+	}
+	return &MsgCrypt{token: token, appId: appId, aesKey: aesKey}, nil
+}
+
+//校验msg_signature并解密微信推送的加密消息，返回明文xml
+func (crypt *MsgCrypt) DecryptMessage(msgSignature string, timestamp string, nonce string, data []byte) ([]byte, error) {
+	var message encryptedMessage
+	err := xml.Unmarshal(data, &message)
+	if err != nil {
+		return nil, err
+	}
+	if message.Encrypt.Value == "" {
+		return nil, errors.New("加密消息没有Encrypt属性")
+	}
+	signature := Signature(crypt.token, timestamp, nonce, message.Encrypt.Value)
+	if subtle.ConstantTimeCompare([]byte(signature), []byte(msgSignature)) != 1 {
+		return nil, errors.New("加密消息msg_signature非法")
+	}
+	return crypt.Decrypt(message.Encrypt.Value)
+}
+
+//加密回复给微信的明文xml，返回带msg_signature的加密xml
+func (crypt *MsgCrypt) EncryptMessage(data []byte, timestamp string, nonce string) ([]byte, error) {
+	encrypt, err := crypt.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	return xml.Marshal(encryptedMessage{
+		Encrypt:      cdata{encrypt},
+		MsgSignature: cdata{Signature(crypt.token, timestamp, nonce, encrypt)},
+		TimeStamp:    timestamp,
+		Nonce:        cdata{nonce},
+	})
+}
+
+func (crypt *MsgCrypt) Decrypt(encrypt string) ([]byte, error) {
+	cipherText, err := base64.StdEncoding.DecodeString(encrypt)
+	if err != nil {
+		return nil, err
+	}
+	if len(cipherText) == 0 || len(cipherText)%aes.BlockSize != 0 {
+		return nil, errors.New("加密消息长度非法")
+	}
+	block, err := aes.NewCipher(crypt.aesKey)
+	if err != nil {
+		return nil, err
+	}
+	plainText := make([]byte, len(cipherText))
+	cipher.NewCBCDecrypter(block, crypt.aesKey[:aes.BlockSize]).CryptBlocks(plainText, cipherText)
+
+	pad := int(plainText[len(plainText)-1])
+	if pad < 1 || pad > blockSize || pad > len(plainText) {
+		return nil, errors.New("加密消息补位非法")
+	}
+	plainText = plainText[:len(plainText)-pad]
+	if len(plainText) < 20 {
+		return nil, errors.New("加密消息长度非法")
+	}
+	length := int(binary.BigEndian.Uint32(plainText[16:20]))
+	if 20+length > len(plainText) {
+		return nil, errors.New("加密消息长度非法")
+	}
+	message := plainText[20 : 20+length]
+	if string(plainText[20+length:]) != crypt.appId {
+		return nil, errors.New("加密消息appId不匹配")
+	}
+	return message, nil
+}
+
+func (crypt *MsgCrypt) Encrypt(message []byte) (string, error) {
+	var buffer bytes.Buffer
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	buffer.Write(random)
+	binary.Write(&buffer, binary.BigEndian, uint32(len(message)))
+	buffer.Write(message)
+	buffer.WriteString(crypt.appId)
+	pad := blockSize - buffer.Len()%blockSize
+	buffer.Write(bytes.Repeat([]byte{byte(pad)}, pad))
+
+	block, err := aes.NewCipher(crypt.aesKey)
+	if err != nil {
+		return "", err
+	}
+	cipherText := make([]byte, buffer.Len())
+	cipher.NewCBCEncrypter(block, crypt.aesKey[:aes.BlockSize]).CryptBlocks(cipherText, buffer.Bytes())
+	return base64.StdEncoding.EncodeToString(cipherText), nil
+}
@@ -0,0 +1,204 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+)
+
+//只出现在客服消息中的消息类型
+const (
+	MsgTypeMpNews          = "mpnews"
+	MsgTypeMenu            = "msgmenu"
+	MsgTypeMiniProgramPage = "miniprogrampage"
+)
+
+//客服输入状态
+const (
+	TypingCommandTyping       = "Typing"
+	TypingCommandCancelTyping = "CancelTyping"
+)
+
+//客服消息，与微信接口的json格式相同，MsgType对应的消息体必须非空，
+//用户48小时内没有和公众号互动时微信返回ErrCodeResponseOutOfTime
+type CustomMessage struct {
+	ToUser          string                 `json:"touser"`
+	MsgType         string                 `json:"msgtype"`
+	Text            *CustomText            `json:"text,omitempty"`
+	Image           *CustomMedia           `json:"image,omitempty"`
+	Voice           *CustomMedia           `json:"voice,omitempty"`
+	Video           *CustomVideo           `json:"video,omitempty"`
+	Music           *CustomMusic           `json:"music,omitempty"`
+	News            *CustomNews            `json:"news,omitempty"`
+	MpNews          *CustomMedia           `json:"mpnews,omitempty"`
+	Menu            *CustomMenu            `json:"msgmenu,omitempty"`
+	MiniProgramPage *CustomMiniProgramPage `json:"miniprogrampage,omitempty"`
+	//以指定的客服帐号发送
+	CustomService *CustomService `json:"customservice,omitempty"`
+}
+
+type CustomText struct {
+	Content string `json:"content"`
+}
+
+//图片、语音和图文(mpnews)消息的素材
+type CustomMedia struct {
+	MediaId string `json:"media_id"`
+}
+
+type CustomVideo struct {
+	MediaId      string `json:"media_id"`
+	ThumbMediaId string `json:"thumb_media_id,omitempty"`
+	Title        string `json:"title,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+type CustomMusic struct {
+	Title        string `json:"title,omitempty"`
+	Description  string `json:"description,omitempty"`
+	MusicUrl     string `json:"musicurl"`
+	HQMusicUrl   string `json:"hqmusicurl"`
+	ThumbMediaId string `json:"thumb_media_id"`
+}
+
+//外链图文消息，微信只展示1篇
+type CustomNews struct {
+	Articles []CustomArticle `json:"articles"`
+}
+
+type CustomArticle struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Url         string `json:"url"`
+	PicUrl      string `json:"picurl,omitempty"`
+}
+
+//菜单消息，用户点击菜单后公众号会收到id对应的文本消息
+type CustomMenu struct {
+	HeadContent string           `json:"head_content,omitempty"`
+	List        []CustomMenuItem `json:"list"`
+	TailContent string           `json:"tail_content,omitempty"`
+}
+
+type CustomMenuItem struct {
+	Id      string `json:"id"`
+	Content string `json:"content"`
+}
+
+//小程序卡片，小程序必须已关联公众号
+type CustomMiniProgramPage struct {
+	Title        string `json:"title,omitempty"`
+	AppId        string `json:"appid"`
+	PagePath     string `json:"pagepath"`
+	ThumbMediaId string `json:"thumb_media_id"`
+}
+
+type CustomService struct {
+	KfAccount string `json:"kf_account"`
+}
+
+//检查MsgType对应的消息体
+func (message CustomMessage) Validate() error {
+	if message.ToUser == "" {
+		return errors.New("客服消息的touser为空")
+	}
+	var ok bool
+	switch message.MsgType {
+	case MsgTypeText:
+		ok = message.Text != nil && message.Text.Content != ""
+	case MsgTypeImage:
+		ok = message.Image != nil && message.Image.MediaId != ""
+	case MsgTypeVoice:
+		ok = message.Voice != nil && message.Voice.MediaId != ""
+	case MsgTypeVideo:
+		ok = message.Video != nil && message.Video.MediaId != ""
+	case MsgTypeMusic:
+		ok = message.Music != nil && message.Music.ThumbMediaId != ""
+	case MsgTypeNews:
+		ok = message.News != nil && len(message.News.Articles) > 0
+	case MsgTypeMpNews:
+		ok = message.MpNews != nil && message.MpNews.MediaId != ""
+	case MsgTypeMenu:
+		ok = message.Menu != nil && len(message.Menu.List) > 0
+	case MsgTypeMiniProgramPage:
+		ok = message.MiniProgramPage != nil && message.MiniProgramPage.AppId != "" && message.MiniProgramPage.PagePath != ""
+	default:
+		return errors.New("不支持的客服消息类型: " + message.MsgType)
+	}
+	if !ok {
+		return errors.New("客服消息的" + message.MsgType + "消息体为空")
+	}
+	return nil
+}
+
+//发送客服消息
+func (client *Client) SendCustomMessage(ctx context.Context, message CustomMessage) error {
+	err := message.Validate()
+	if err != nil {
+		return err
+	}
+	jsonString, err := client.callOnce(ctx, "发送客服消息", http.MethodPost, "/cgi-bin/message/custom/send", message)
+	if err != nil {
+		return err
+	}
+	_, err = client.analysisSuccess("发送客服消息", jsonString)
+	if err != nil {
+		return err
+	}
+	client.log.WithFields(logrus.Fields{"openId": message.ToUser, "msgType": message.MsgType}).Info("发送客服消息成功")
+	return nil
+}
+
+//下发或取消客服输入状态，command为TypingCommandTyping或TypingCommandCancelTyping
+func (client *Client) SendTyping(ctx context.Context, openId string, command string) error {
+	if command != TypingCommandTyping && command != TypingCommandCancelTyping {
+		return errors.New("客服输入状态非法: " + command)
+	}
+	jsonString, err := client.call(ctx, "下发客服输入状态", http.MethodPost, "/cgi-bin/message/custom/typing", map[string]interface{}{
+		"touser":  openId,
+		"command": command,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.analysisSuccess("下发客服输入状态", jsonString)
+	return err
+}
+
+//把被动回复转换为同样内容的客服消息，来不及被动回复时改用客服消息发送，SuccessReply返回false
+func ReplyToCustomMessage(openId string, reply Reply) (CustomMessage, bool) {
+	message := CustomMessage{ToUser: openId, MsgType: reply.MsgType()}
+	switch reply := reply.(type) {
+	case TextReply:
+		message.Text = &CustomText{Content: reply.Content}
+	case ImageReply:
+		message.Image = &CustomMedia{MediaId: reply.MediaId}
+	case VoiceReply:
+		message.Voice = &CustomMedia{MediaId: reply.MediaId}
+	case VideoReply:
+		message.Video = &CustomVideo{MediaId: reply.MediaId, Title: reply.Title, Description: reply.Description}
+	case MusicReply:
+		message.Music = &CustomMusic{
+			Title:        reply.Title,
+			Description:  reply.Description,
+			MusicUrl:     reply.MusicUrl,
+			HQMusicUrl:   reply.HQMusicUrl,
+			ThumbMediaId: reply.ThumbMediaId,
+		}
+	case NewsReply:
+		articles := make([]CustomArticle, len(reply.Articles))
+		for i := range reply.Articles {
+			articles[i] = CustomArticle{
+				Title:       reply.Articles[i].Title,
+				Description: reply.Articles[i].Description,
+				Url:         reply.Articles[i].Url,
+				PicUrl:      reply.Articles[i].PicUrl,
+			}
+		}
+		message.News = &CustomNews{Articles: articles}
+	default:
+		return message, false
+	}
+	return message, true
+}
@@ -0,0 +1,85 @@
+package wechat
+
+import (
+	"fmt"
+)
+
+//微信全局返回码，完整列表见公众号文档
+const (
+	ErrCodeSystemBusy         = -1
+	ErrCodeOk                 = 0
+	ErrCodeInvalidCredential  = 40001
+	ErrCodeInvalidOpenId      = 40003
+	ErrCodeInvalidAppId       = 40013
+	ErrCodeInvalidAccessToken = 40014
+	ErrCodeInvalidTemplateId  = 40037
+	ErrCodeInvalidAppSecret   = 40125
+	ErrCodeIpNotInWhitelist   = 40164
+	ErrCodeAccessTokenMissing = 41001
+	ErrCodeAccessTokenExpired = 42001
+	ErrCodeRequireSubscribe   = 43004
+	ErrCodeApiFreqOutOfLimit  = 45009
+	ErrCodeResponseOutOfTime  = 45015
+	ErrCodeOutOfResponseCount = 45047
+	ErrCodeTagNameDuplicated  = 45157
+	ErrCodeInvalidTagId       = 45159
+	ErrCodeDataFormatError    = 47001
+	ErrCodeApiUnauthorized    = 48001
+)
+
+//微信接口返回的错误，保留了errcode、errmsg和出错的接口名称
+type WeChatError struct {
+	Api     string `json:"api"`
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func (err *WeChatError) Error() string {
+	return fmt.Sprintf("%s失败: errcode=%d, errmsg=%s", err.Api, err.ErrCode, err.ErrMsg)
+}
+
+//获取err对应的微信错误，err不是微信接口返回的错误时返回false
+func AsWeChatError(err error) (*WeChatError, bool) {
+	weChatError, ok := err.(*WeChatError)
+	return weChatError, ok && weChatError != nil
+}
+
+//获取err的微信errcode，err不是微信接口返回的错误时返回false
+func ErrCode(err error) (int, bool) {
+	weChatError, ok := AsWeChatError(err)
+	if !ok {
+		return 0, false
+	}
+	return weChatError.ErrCode, true
+}
+
+//请求微信接口时网络异常或响应码不是200，StatusCode为0表示网络异常，Err为网络异常的原因
+type RequestError struct {
+	Api        string `json:"api"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Err        error  `json:"-"`
+}
+
+func (err *RequestError) Error() string {
+	if err.StatusCode == 0 {
+		if err.Err != nil {
+			return err.Api + "请求异常: " + err.Err.Error()
+		}
+		return err.Api + "请求异常"
+	}
+	return fmt.Sprintf("%s响应码异常: %d", err.Api, err.StatusCode)
+}
+
+func (err *RequestError) Unwrap() error {
+	return err.Err
+}
+
+//重试可能成功的错误：网络异常、5xx响应码、系统繁忙和频率限制
+//其他错误比如4xx响应码、43004用户未关注、40003 openid非法，重试也不会成功
+func IsRetryable(err error) bool {
+	if requestError, ok := err.(*RequestError); ok {
+		return requestError.StatusCode == 0 || requestError.StatusCode >= 500
+	}
+	errCode, ok := ErrCode(err)
+	return ok && (errCode == ErrCodeSystemBusy || errCode == ErrCodeApiFreqOutOfLimit || errCode == ErrCodeOutOfResponseCount)
+}
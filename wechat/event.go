@@ -0,0 +1,150 @@
+package wechat
+
+import (
+	"strings"
+)
+
+//事件类型
+const (
+	EventSubscribe             = "subscribe"
+	EventUnsubscribe           = "unsubscribe"
+	EventScan                  = "SCAN"
+	EventLocation              = "LOCATION"
+	EventClick                 = "CLICK"
+	EventView                  = "VIEW"
+	EventTemplateSendJobFinish = "TEMPLATESENDJOBFINISH"
+	EventMassSendJobFinish     = "MASSSENDJOBFINISH"
+)
+
+//模板消息发送结果
+const (
+	TemplateSendStatusSuccess      = "success"
+	TemplateSendStatusUserBlock    = "failed:user block"
+	TemplateSendStatusSystemFailed = "failed:system failed"
+)
+
+//所有事件共有的字段
+type EventHeader struct {
+	ToUserName   string `json:"ToUserName"`
+	FromUserName string `json:"FromUserName"`
+	CreateTime   int64  `json:"CreateTime"`
+	Event        string `json:"Event"`
+}
+
+type Event interface {
+	Header() EventHeader
+}
+
+func (header EventHeader) Header() EventHeader {
+	return header
+}
+
+//关注事件，扫带参数二维码关注时EventKey为qrscene_前缀加场景值
+type SubscribeEvent struct {
+	EventHeader
+	EventKey string `json:"EventKey,omitempty"`
+	Ticket   string `json:"Ticket,omitempty"`
+}
+
+//扫带参数二维码关注时的场景值
+func (event SubscribeEvent) SceneValue() string {
+	return strings.TrimPrefix(event.EventKey, "qrscene_")
+}
+
+//取消关注事件
+type UnsubscribeEvent struct {
+	EventHeader
+}
+
+//已关注用户扫带参数二维码事件，EventKey为场景值
+type ScanEvent struct {
+	EventHeader
+	EventKey string `json:"EventKey"`
+	Ticket   string `json:"Ticket"`
+}
+
+//上报地理位置事件
+type LocationEvent struct {
+	EventHeader
+	Latitude  float64 `json:"Latitude"`
+	Longitude float64 `json:"Longitude"`
+	Precision float64 `json:"Precision"`
+}
+
+//点击菜单拉取消息事件，EventKey为菜单的key
+type MenuClickEvent struct {
+	EventHeader
+	EventKey string `json:"EventKey"`
+}
+
+//点击菜单跳转链接事件
+type MenuViewEvent struct {
+	EventHeader
+	Url string `json:"Url"`
+}
+
+//模板消息发送结果事件
+type TemplateSendJobFinishEvent struct {
+	EventHeader
+	MsgId  int64  `json:"MsgID"`
+	Status string `json:"Status"`
+}
+
+//群发消息发送结果事件，Status为send success、send fail或err(错误码)，
+//TotalCount为标签或全部粉丝数，FilterCount为过滤后准备发送的粉丝数
+type MassSendJobFinishEvent struct {
+	EventHeader
+	MsgId       int64  `json:"MsgID"`
+	Status      string `json:"Status"`
+	TotalCount  int    `json:"TotalCount"`
+	FilterCount int    `json:"FilterCount"`
+	SentCount   int    `json:"SentCount"`
+	ErrorCount  int    `json:"ErrorCount"`
+}
+
+//未单独建模的事件
+type UnknownEvent struct {
+	EventHeader
+	Message *Message `json:"Message"`
+}
+
+//把事件推送转换为对应的事件类型，不是事件推送时返回false
+func ParseEvent(message *Message) (Event, bool) {
+	if message.MsgType != MsgTypeEvent {
+		return nil, false
+	}
+	header := EventHeader{
+		ToUserName:   message.ToUserName,
+		FromUserName: message.FromUserName,
+		CreateTime:   message.CreateTime,
+		Event:        message.Event,
+	}
+	switch message.Event {
+	case EventSubscribe:
+		return SubscribeEvent{EventHeader: header, EventKey: message.EventKey, Ticket: message.Ticket}, true
+	case EventUnsubscribe:
+		return UnsubscribeEvent{EventHeader: header}, true
+	case EventScan:
+		return ScanEvent{EventHeader: header, EventKey: message.EventKey, Ticket: message.Ticket}, true
+	case EventLocation:
+		return LocationEvent{EventHeader: header, Latitude: message.Latitude, Longitude: message.Longitude, Precision: message.Precision}, true
+	case EventClick:
+		return MenuClickEvent{EventHeader: header, EventKey: message.EventKey}, true
+	case EventView:
+		return MenuViewEvent{EventHeader: header, Url: message.EventKey}, true
+	case EventTemplateSendJobFinish:
+		return TemplateSendJobFinishEvent{EventHeader: header, MsgId: message.MsgID, Status: message.Status}, true
+	case EventMassSendJobFinish:
+		return MassSendJobFinishEvent{
+			EventHeader: header,
+			MsgId:       message.MsgID,
+			Status:      message.Status,
+			TotalCount:  message.TotalCount,
+			FilterCount: message.FilterCount,
+			SentCount:   message.SentCount,
+			ErrorCount:  message.ErrorCount,
+		}, true
+	default:
+		return UnknownEvent{EventHeader: header, Message: message}, true
+	}
+}
@@ -0,0 +1,164 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"github.com/tidwall/gjson"
+	"net/http"
+)
+
+//只出现在群发消息中的消息类型
+const (
+	MsgTypeMpVideo = "mpvideo"
+	MsgTypeWxCard  = "wxcard"
+)
+
+//群发消息的内容，与微信接口的json格式相同，收件人由发送方法决定
+type MassMessage struct {
+	MsgType string       `json:"msgtype"`
+	MpNews  *CustomMedia `json:"mpnews,omitempty"`
+	Text    *CustomText  `json:"text,omitempty"`
+	Voice   *CustomMedia `json:"voice,omitempty"`
+	Image   *MassImage   `json:"images,omitempty"`
+	MpVideo *CustomMedia `json:"mpvideo,omitempty"`
+	WxCard  *MassWxCard  `json:"wxcard,omitempty"`
+	//图文被判定为转载时，1继续群发，0停止群发
+	SendIgnoreReprint int `json:"send_ignore_reprint"`
+	//开发者侧的群发id，24小时内相同clientmsgid的群发微信只执行一次
+	ClientMsgId string `json:"clientmsgid,omitempty"`
+}
+
+//图片群发，一次最多8张
+type MassImage struct {
+	MediaIds           []string `json:"media_ids"`
+	Recommend          string   `json:"recommend,omitempty"`
+	NeedOpenComment    int      `json:"need_open_comment,omitempty"`
+	OnlyFansCanComment int      `json:"only_fans_can_comment,omitempty"`
+}
+
+type MassWxCard struct {
+	CardId string `json:"card_id"`
+}
+
+//按标签群发时的筛选条件，IsToAll为true时忽略TagId
+type MassFilter struct {
+	IsToAll bool `json:"is_to_all"`
+	TagId   int  `json:"tag_id,omitempty"`
+}
+
+//群发结果，MsgDataId只有图文群发才有，用于图文分析
+type MassResult struct {
+	MsgId     int64 `json:"msg_id"`
+	MsgDataId int64 `json:"msg_data_id,omitempty"`
+}
+
+//群发状态，MsgStatus为SEND_SUCCESS、SENDING、SEND_FAIL或DELETE
+type MassStatus struct {
+	MsgId     int64  `json:"msg_id"`
+	MsgStatus string `json:"msg_status"`
+}
+
+func (message MassMessage) Validate() error {
+	var ok bool
+	switch message.MsgType {
+	case MsgTypeMpNews:
+		ok = message.MpNews != nil && message.MpNews.MediaId != ""
+	case MsgTypeText:
+		ok = message.Text != nil && message.Text.Content != ""
+	case MsgTypeVoice:
+		ok = message.Voice != nil && message.Voice.MediaId != ""
+	case MsgTypeImage:
+		ok = message.Image != nil && len(message.Image.MediaIds) > 0
+	case MsgTypeMpVideo:
+		ok = message.MpVideo != nil && message.MpVideo.MediaId != ""
+	case MsgTypeWxCard:
+		ok = message.WxCard != nil && message.WxCard.CardId != ""
+	default:
+		return errors.New("不支持的群发消息类型: " + message.MsgType)
+	}
+	if !ok {
+		return errors.New("群发消息的" + message.MsgType + "消息体为空")
+	}
+	return nil
+}
+
+//按标签群发，isToAll为true时发给全部粉丝，群发结果在MASSSENDJOBFINISH事件推送
+func (client *Client) SendMassToTag(ctx context.Context, tagId int, isToAll bool, message MassMessage) (MassResult, error) {
+	if !isToAll && tagId <= 0 {
+		return MassResult{}, errors.New("按标签群发的tagId非法")
+	}
+	if err := message.Validate(); err != nil {
+		return MassResult{}, err
+	}
+	return client.sendMass(ctx, "按标签群发", "/cgi-bin/message/mass/sendall", struct {
+		Filter MassFilter `json:"filter"`
+		MassMessage
+	}{MassFilter{IsToAll: isToAll, TagId: tagId}, message})
+}
+
+//按openid列表群发，微信要求至少2个openid，最多10000个
+func (client *Client) SendMassToUsers(ctx context.Context, openIds []string, message MassMessage) (MassResult, error) {
+	if len(openIds) < 2 || len(openIds) > 10000 {
+		return MassResult{}, errors.New("按openid群发的用户数必须为2到10000个")
+	}
+	if err := message.Validate(); err != nil {
+		return MassResult{}, err
+	}
+	return client.sendMass(ctx, "按openid群发", "/cgi-bin/message/mass/send", struct {
+		ToUser []string `json:"touser"`
+		MassMessage
+	}{openIds, message})
+}
+
+//群发前发给一个用户预览
+func (client *Client) PreviewMass(ctx context.Context, openId string, message MassMessage) (MassResult, error) {
+	if openId == "" {
+		return MassResult{}, errors.New("预览群发的openid为空")
+	}
+	if err := message.Validate(); err != nil {
+		return MassResult{}, err
+	}
+	return client.sendMass(ctx, "预览群发", "/cgi-bin/message/mass/preview", struct {
+		ToUser string `json:"touser"`
+		MassMessage
+	}{openId, message})
+}
+
+func (client *Client) sendMass(ctx context.Context, name string, path string, body interface{}) (MassResult, error) {
+	var result MassResult
+	jsonString, err := client.callOnce(ctx, name, http.MethodPost, path, body)
+	if err != nil {
+		return result, err
+	}
+	err = client.analysisObject(name, jsonString, "msg_id", &result.MsgId)
+	if err != nil {
+		return result, err
+	}
+	result.MsgDataId = gjson.Get(jsonString, "msg_data_id").Int()
+	return result, nil
+}
+
+//查询群发状态
+func (client *Client) GetMass(ctx context.Context, msgId int64) (MassStatus, error) {
+	status := MassStatus{MsgId: msgId}
+	jsonString, err := client.call(ctx, "查询群发状态", http.MethodPost, "/cgi-bin/message/mass/get", map[string]interface{}{
+		"msg_id": msgId,
+	})
+	if err != nil {
+		return status, err
+	}
+	err = client.analysisObject("查询群发状态", jsonString, "msg_status", &status.MsgStatus)
+	return status, err
+}
+
+//删除群发，只能删除图文和视频，articleIdx为图文中的第几篇，0删除全部
+func (client *Client) DeleteMass(ctx context.Context, msgId int64, articleIdx int) (bool, error) {
+	jsonString, err := client.call(ctx, "删除群发", http.MethodPost, "/cgi-bin/message/mass/delete", map[string]interface{}{
+		"msg_id":      msgId,
+		"article_idx": articleIdx,
+	})
+	if err != nil {
+		return false, err
+	}
+	return client.analysisSuccess("删除群发", jsonString)
+}
@@ -0,0 +1,93 @@
+package wechat
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gomodule/redigo/redis"
+	"time"
+)
+
+//只有锁仍由自己持有时才删除
+var unlockScript = redis.NewScript(1, `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`)
+
+//Redis协议存储，跨机器的多个副本共用，刷新锁是key+":lock"
+type RedisTokenStore struct {
+	pool  *redis.Pool
+	key   string
+	owner string
+}
+
+func NewRedisTokenStore(address string, password string, key string) *RedisTokenStore {
+	pool := &redis.Pool{
+		MaxIdle:     3,
+		IdleTimeout: 5 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", address,
+				redis.DialPassword(password),
+				redis.DialConnectTimeout(DefaultTimeout),
+				redis.DialReadTimeout(DefaultTimeout),
+				redis.DialWriteTimeout(DefaultTimeout))
+		},
+	}
+	return &RedisTokenStore{pool: pool, key: key, owner: newLockOwner()}
+}
+
+func (store *RedisTokenStore) Get(ctx context.Context) (Token, error) {
+	conn, err := store.pool.GetContext(ctx)
+	if err != nil {
+		return Token{}, err
+	}
+	defer conn.Close()
+	data, err := redis.Bytes(conn.Do("GET", store.key))
+	if err == redis.ErrNil {
+		return Token{}, nil
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	var token Token
+	err = json.Unmarshal(data, &token)
+	return token, err
+}
+
+//key随accessToken一起过期
+func (store *RedisTokenStore) Set(ctx context.Context, token Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	conn, err := store.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	ttl := token.TTL()
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	_, err = conn.Do("SET", store.key, data, "PX", int64(ttl/time.Millisecond))
+	return err
+}
+
+func (store *RedisTokenStore) Lock(ctx context.Context, ttl time.Duration) (bool, error) {
+	conn, err := store.pool.GetContext(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	_, err = redis.String(conn.Do("SET", store.key+":lock", store.owner, "NX", "PX", int64(ttl/time.Millisecond)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (store *RedisTokenStore) Unlock(ctx context.Context) error {
+	conn, err := store.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = unlockScript.Do(conn, store.key+":lock", store.owner)
+	return err
+}
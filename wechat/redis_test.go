@@ -0,0 +1,172 @@
+package wechat
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//进程内的Redis协议桩，只实现RedisTokenStore用到的GET、SET、DEL和解锁脚本
+type redisStub struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	values   map[string]string
+	expires  map[string]time.Time
+}
+
+func newRedisStub(t *testing.T) *redisStub {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &redisStub{listener: listener, values: map[string]string{}, expires: map[string]time.Time{}}
+	go stub.serve()
+	return stub
+}
+
+func (stub *redisStub) address() string {
+	return stub.listener.Addr().String()
+}
+
+func (stub *redisStub) close() {
+	stub.listener.Close()
+}
+
+func (stub *redisStub) serve() {
+	for {
+		conn, err := stub.listener.Accept()
+		if err != nil {
+			return
+		}
+		go stub.handle(conn)
+	}
+}
+
+func (stub *redisStub) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		if _, err := io.WriteString(conn, stub.do(args)); err != nil {
+			return
+		}
+	}
+}
+
+//读取一条数组形式的命令
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, errors.New("不支持的命令格式: " + line)
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
+
+func bulkString(value string) string {
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+}
+
+func (stub *redisStub) get(key string) (string, bool) {
+	if expiresAt, ok := stub.expires[key]; ok && !time.Now().Before(expiresAt) {
+		delete(stub.values, key)
+		delete(stub.expires, key)
+	}
+	value, ok := stub.values[key]
+	return value, ok
+}
+
+func (stub *redisStub) do(args []string) string {
+	stub.mutex.Lock()
+	defer stub.mutex.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "GET":
+		value, ok := stub.get(args[1])
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulkString(value)
+	case "SET":
+		key := args[1]
+		var expiresAt time.Time
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				if _, ok := stub.get(key); ok {
+					return "$-1\r\n"
+				}
+			case "PX":
+				i++
+				milliseconds, _ := strconv.ParseInt(args[i], 10, 64)
+				expiresAt = time.Now().Add(time.Duration(milliseconds) * time.Millisecond)
+			}
+		}
+		stub.values[key] = args[2]
+		delete(stub.expires, key)
+		if !expiresAt.IsZero() {
+			stub.expires[key] = expiresAt
+		}
+		return "+OK\r\n"
+	case "EVALSHA":
+		return "-NOSCRIPT No matching script\r\n"
+	case "EVAL":
+		//只有unlockScript一个脚本：值等于ARGV[1]时删除KEYS[1]
+		if value, ok := stub.get(args[3]); ok && value == args[4] {
+			delete(stub.values, args[3])
+			delete(stub.expires, args[3])
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	}
+	return "-ERR unknown command '" + args[0] + "'\r\n"
+}
+
+func TestRedisTokenStore(t *testing.T) {
+	stub := newRedisStub(t)
+	defer stub.close()
+	testTokenStore(t, NewRedisTokenStore(stub.address(), "", "token"), NewRedisTokenStore(stub.address(), "", "token"))
+}
+
+//多个副本同时抢锁，只能有一个拿到锁
+func TestRedisTokenStoreLockConcurrently(t *testing.T) {
+	stub := newRedisStub(t)
+	defer stub.close()
+	stores := make([]TokenStore, 8)
+	for i := range stores {
+		stores[i] = NewRedisTokenStore(stub.address(), "", "token")
+	}
+	if locked := lockConcurrently(stores, time.Minute); locked != 1 {
+		t.Fatalf("有%d个副本拿到了锁", locked)
+	}
+}
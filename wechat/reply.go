@@ -0,0 +1,332 @@
+package wechat
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"strings"
+)
+
+//只出现在回复中的消息类型
+const (
+	MsgTypeNews  = "news"
+	MsgTypeMusic = "music"
+	//不回复，直接给微信返回success
+	MsgTypeSuccess = "success"
+)
+
+//图文回复最多的文章数，回复用户发来的消息时微信只展示1篇
+const maxNewsArticleCount = 8
+
+//被动回复用户消息
+type Reply interface {
+	MsgType() string
+	//检查必填字段
+	Validate() error
+	//生成回复给微信的xml，toUserName是用户openid，fromUserName是公众号原始id
+	Xml(toUserName string, fromUserName string, createTime int64) ([]byte, error)
+}
+
+//按收到的消息生成被动回复，调换收发双方，reply为空或SuccessReply时返回空
+func BuildReply(message *Message, reply Reply, createTime int64) ([]byte, error) {
+	if reply == nil {
+		return nil, nil
+	}
+	return reply.Xml(message.FromUserName, message.ToUserName, createTime)
+}
+
+//xml中的CDATA节，序列化时去掉xml不允许的控制字符，内容中的"]]>"拆到两个CDATA节，
+//空值也输出<![CDATA[]]>，与微信文档的示例保持一致
+type cdata struct {
+	Value string `xml:",cdata"`
+}
+
+func (value cdata) MarshalXML(encoder *xml.Encoder, start xml.StartElement) error {
+	text := strings.Replace(strings.Map(xmlRune, value.Value), "]]>", "]]]]><![CDATA[>", -1)
+	return encoder.EncodeElement(struct {
+		Inner string `xml:",innerxml"`
+	}{"<![CDATA[" + text + "]]>"}, start)
+}
+
+//xml 1.0允许的字符，其余字符丢弃
+func xmlRune(r rune) rune {
+	if r == '\t' || r == '\n' || r == '\r' ||
+		r >= 0x20 && r <= 0xD7FF ||
+		r >= 0xE000 && r <= 0xFFFD ||
+		r >= 0x10000 && r <= 0x10FFFF {
+		return r
+	}
+	return -1
+}
+
+//回复xml的公共字段
+type replyHeader struct {
+	XMLName      xml.Name `xml:"xml"`
+	ToUserName   cdata    `xml:"ToUserName"`
+	FromUserName cdata    `xml:"FromUserName"`
+	CreateTime   int64    `xml:"CreateTime"`
+	MsgType      cdata    `xml:"MsgType"`
+}
+
+func newReplyHeader(toUserName string, fromUserName string, createTime int64, msgType string) replyHeader {
+	return replyHeader{
+		ToUserName:   cdata{toUserName},
+		FromUserName: cdata{fromUserName},
+		CreateTime:   createTime,
+		MsgType:      cdata{msgType},
+	}
+}
+
+//生成回复xml前先校验
+func marshalReply(reply Reply, body interface{}) ([]byte, error) {
+	err := reply.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return xml.Marshal(body)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//不回复用户，微信要求此时返回success或空串
+type SuccessReply struct {
+}
+
+func (reply SuccessReply) MsgType() string {
+	return MsgTypeSuccess
+}
+
+func (reply SuccessReply) Validate() error {
+	return nil
+}
+
+func (reply SuccessReply) Xml(toUserName string, fromUserName string, createTime int64) ([]byte, error) {
+	return nil, nil
+}
+
+//回复文本消息
+type TextReply struct {
+	Content string `json:"Content"`
+}
+
+func (reply TextReply) MsgType() string {
+	return MsgTypeText
+}
+
+func (reply TextReply) Validate() error {
+	if reply.Content == "" {
+		return errors.New("文本回复的Content为空")
+	}
+	return nil
+}
+
+func (reply TextReply) Xml(toUserName string, fromUserName string, createTime int64) ([]byte, error) {
+	return marshalReply(reply, struct {
+		replyHeader
+		Content cdata `xml:"Content"`
+	}{newReplyHeader(toUserName, fromUserName, createTime, MsgTypeText), cdata{reply.Content}})
+}
+
+//回复图片消息，MediaId为素材的media_id
+type ImageReply struct {
+	MediaId string `json:"MediaId"`
+}
+
+func (reply ImageReply) MsgType() string {
+	return MsgTypeImage
+}
+
+func (reply ImageReply) Validate() error {
+	if reply.MediaId == "" {
+		return errors.New("图片回复的MediaId为空")
+	}
+	return nil
+}
+
+func (reply ImageReply) Xml(toUserName string, fromUserName string, createTime int64) ([]byte, error) {
+	return marshalReply(reply, struct {
+		replyHeader
+		MediaId cdata `xml:"Image>MediaId"`
+	}{newReplyHeader(toUserName, fromUserName, createTime, MsgTypeImage), cdata{reply.MediaId}})
+}
+
+//回复语音消息
+type VoiceReply struct {
+	MediaId string `json:"MediaId"`
+}
+
+func (reply VoiceReply) MsgType() string {
+	return MsgTypeVoice
+}
+
+func (reply VoiceReply) Validate() error {
+	if reply.MediaId == "" {
+		return errors.New("语音回复的MediaId为空")
+	}
+	return nil
+}
+
+func (reply VoiceReply) Xml(toUserName string, fromUserName string, createTime int64) ([]byte, error) {
+	return marshalReply(reply, struct {
+		replyHeader
+		MediaId cdata `xml:"Voice>MediaId"`
+	}{newReplyHeader(toUserName, fromUserName, createTime, MsgTypeVoice), cdata{reply.MediaId}})
+}
+
+//回复视频消息，Title和Description可以为空
+type VideoReply struct {
+	MediaId     string `json:"MediaId"`
+	Title       string `json:"Title"`
+	Description string `json:"Description"`
+}
+
+func (reply VideoReply) MsgType() string {
+	return MsgTypeVideo
+}
+
+func (reply VideoReply) Validate() error {
+	if reply.MediaId == "" {
+		return errors.New("视频回复的MediaId为空")
+	}
+	return nil
+}
+
+func (reply VideoReply) Xml(toUserName string, fromUserName string, createTime int64) ([]byte, error) {
+	return marshalReply(reply, struct {
+		replyHeader
+		MediaId     cdata `xml:"Video>MediaId"`
+		Title       cdata `xml:"Video>Title"`
+		Description cdata `xml:"Video>Description"`
+	}{newReplyHeader(toUserName, fromUserName, createTime, MsgTypeVideo), cdata{reply.MediaId}, cdata{reply.Title}, cdata{reply.Description}})
+}
+
+//回复音乐消息，ThumbMediaId为缩略图的media_id
+type MusicReply struct {
+	Title        string `json:"Title"`
+	Description  string `json:"Description"`
+	MusicUrl     string `json:"MusicUrl"`
+	HQMusicUrl   string `json:"HQMusicUrl"`
+	ThumbMediaId string `json:"ThumbMediaId"`
+}
+
+func (reply MusicReply) MsgType() string {
+	return MsgTypeMusic
+}
+
+func (reply MusicReply) Validate() error {
+	if reply.ThumbMediaId == "" {
+		return errors.New("音乐回复的ThumbMediaId为空")
+	}
+	return nil
+}
+
+func (reply MusicReply) Xml(toUserName string, fromUserName string, createTime int64) ([]byte, error) {
+	return marshalReply(reply, struct {
+		replyHeader
+		Title        cdata `xml:"Music>Title"`
+		Description  cdata `xml:"Music>Description"`
+		MusicUrl     cdata `xml:"Music>MusicUrl"`
+		HQMusicUrl   cdata `xml:"Music>HQMusicUrl"`
+		ThumbMediaId cdata `xml:"Music>ThumbMediaId"`
+	}{newReplyHeader(toUserName, fromUserName, createTime, MsgTypeMusic),
+		cdata{reply.Title}, cdata{reply.Description}, cdata{reply.MusicUrl}, cdata{reply.HQMusicUrl}, cdata{reply.ThumbMediaId}})
+}
+
+//图文消息中的一篇文章
+type Article struct {
+	Title       string `json:"Title"`
+	Description string `json:"Description"`
+	PicUrl      string `json:"PicUrl"`
+	Url         string `json:"Url"`
+}
+
+type articleXml struct {
+	Title       cdata `xml:"Title"`
+	Description cdata `xml:"Description"`
+	PicUrl      cdata `xml:"PicUrl"`
+	Url         cdata `xml:"Url"`
+}
+
+//回复图文消息，回复用户发来的消息时微信只展示1篇，其余场景最多8篇
+type NewsReply struct {
+	Articles []Article `json:"Articles"`
+}
+
+func (reply NewsReply) MsgType() string {
+	return MsgTypeNews
+}
+
+func (reply NewsReply) Validate() error {
+	if len(reply.Articles) == 0 || len(reply.Articles) > maxNewsArticleCount {
+		return errors.New("图文回复的文章数必须为1到8篇")
+	}
+	return nil
+}
+
+func (reply NewsReply) Xml(toUserName string, fromUserName string, createTime int64) ([]byte, error) {
+	articles := make([]articleXml, len(reply.Articles))
+	for i := range reply.Articles {
+		articles[i] = articleXml{
+			Title:       cdata{reply.Articles[i].Title},
+			Description: cdata{reply.Articles[i].Description},
+			PicUrl:      cdata{reply.Articles[i].PicUrl},
+			Url:         cdata{reply.Articles[i].Url},
+		}
+	}
+	return marshalReply(reply, struct {
+		replyHeader
+		ArticleCount int          `xml:"ArticleCount"`
+		Articles     []articleXml `xml:"Articles>item"`
+	}{newReplyHeader(toUserName, fromUserName, createTime, MsgTypeNews), len(articles), articles})
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//从json解析并校验回复，json的MsgType决定回复类型，供webhook和自动回复规则使用
+func UnmarshalReply(data []byte) (Reply, error) {
+	var header struct {
+		MsgType string `json:"MsgType"`
+	}
+	err := json.Unmarshal(data, &header)
+	if err != nil {
+		return nil, err
+	}
+	var reply Reply
+	switch header.MsgType {
+	case MsgTypeSuccess:
+		return SuccessReply{}, nil
+	case MsgTypeText:
+		var textReply TextReply
+		err = json.Unmarshal(data, &textReply)
+		reply = textReply
+	case MsgTypeImage:
+		var imageReply ImageReply
+		err = json.Unmarshal(data, &imageReply)
+		reply = imageReply
+	case MsgTypeVoice:
+		var voiceReply VoiceReply
+		err = json.Unmarshal(data, &voiceReply)
+		reply = voiceReply
+	case MsgTypeVideo:
+		var videoReply VideoReply
+		err = json.Unmarshal(data, &videoReply)
+		reply = videoReply
+	case MsgTypeMusic:
+		var musicReply MusicReply
+		err = json.Unmarshal(data, &musicReply)
+		reply = musicReply
+	case MsgTypeNews:
+		var newsReply NewsReply
+		err = json.Unmarshal(data, &newsReply)
+		reply = newsReply
+	default:
+		return nil, errors.New("不支持的回复类型: " + header.MsgType)
+	}
+	if err == nil {
+		err = reply.Validate()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
@@ -0,0 +1,55 @@
+package wechat
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+//标签之间的缩进和换行，testdata中的示例为了可读性带了缩进
+var xmlIndent = regexp.MustCompile(`>\s+<`)
+
+//testdata中是微信文档的被动回复示例，用户toUser发给公众号fromUser
+func TestBuildReplyGolden(t *testing.T) {
+	message := &Message{ToUserName: "fromUser", FromUserName: "toUser", CreateTime: 12345678, MsgType: MsgTypeText}
+	tests := []struct {
+		name  string
+		reply Reply
+	}{
+		{"text", TextReply{Content: "你好"}},
+		{"image", ImageReply{MediaId: "media_id"}},
+		{"voice", VoiceReply{MediaId: "media_id"}},
+		{"video", VideoReply{MediaId: "media_id", Title: "title", Description: "description"}},
+		{"music", MusicReply{Title: "TITLE", Description: "DESCRIPTION", MusicUrl: "MUSIC_Url", HQMusicUrl: "HQ_MUSIC_Url", ThumbMediaId: "media_id"}},
+		{"news", NewsReply{Articles: []Article{{Title: "title1", Description: "description1", PicUrl: "picurl", Url: "url"}}}},
+		//"]]>"拆到两个CDATA节，去掉控制字符，保留制表符，<>&在CDATA中不转义
+		{"text_escape", TextReply{Content: "a]]>b<c>&d\x00\x01\x0b\x1f\te"}},
+	}
+	for _, test := range tests {
+		golden, err := ioutil.ReadFile(filepath.Join("testdata", test.name+".xml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := xmlIndent.ReplaceAllString(strings.TrimSpace(string(golden)), "><")
+		got, err := BuildReply(message, test.reply, 12345678)
+		if err != nil {
+			t.Errorf("%s回复生成失败: %v", test.name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s回复\n得到 %s\n期望 %s", test.name, got, want)
+		}
+	}
+}
+
+func TestBuildReplyEmpty(t *testing.T) {
+	message := &Message{ToUserName: "fromUser", FromUserName: "toUser"}
+	for _, reply := range []Reply{nil, SuccessReply{}} {
+		got, err := BuildReply(message, reply, 12345678)
+		if err != nil || got != nil {
+			t.Errorf("%T回复得到 %q %v，期望为空", reply, got, err)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+//从网关获取accessToken，网关是accessToken的唯一来源，避免各服务互相使对方的accessToken失效
+func (client *Client) flushSharedAccessToken(ctx context.Context, stale string) (Token, error) {
+	var err error
+	for i := 0; i < client.retry; i++ {
+		var jsonString string
+		jsonString, err = client.requestSharedAccessToken(ctx, stale)
+		if err == nil {
+			return client.analysisSharedAccessToken(jsonString)
+		}
+	}
+	return Token{}, err
+}
+
+func (client *Client) analysisSharedAccessToken(jsonString string) (Token, error) {
+	if !gjson.Valid(jsonString) {
+		client.log.Error("从网关获取accessToken响应json非法")
+		return Token{}, errors.New("从网关获取accessToken响应json非法")
+	}
+	if gjson.Get(jsonString, "code").Int() != 1 {
+		errcode := gjson.Get(jsonString, "errcode")
+		if errcode.Exists() {
+			return Token{}, &WeChatError{Api: gjson.Get(jsonString, "api").String(), ErrCode: int(errcode.Int()), ErrMsg: gjson.Get(jsonString, "errmsg").String()}
+		}
+		client.log.WithFields(logrus.Fields{"body": jsonString}).Error("从网关获取accessToken失败")
+		return Token{}, errors.New("从网关获取accessToken失败")
+	}
+	result := gjson.Get(jsonString, "data.access_token")
+	if !result.Exists() {
+		client.log.Error("从网关获取accessToken响应json没有access_token属性")
+		return Token{}, errors.New("从网关获取accessToken响应json没有access_token属性")
+	}
+	token := Token{
+		AccessToken: result.String(),
+		ExpiresAt:   time.Now().Add(time.Duration(gjson.Get(jsonString, "data.expires_in").Int()) * time.Second),
+	}
+	client.log.WithFields(logrus.Fields{"accessToken": len(token.AccessToken), "expiresAt": token.ExpiresAt}).Info("从网关获取accessToken长度")
+	return token, nil
+}
+
+//只有微信拒绝了stale时才带上stale参数，网关收到stale会强制刷新，正常过期时不能带
+func (client *Client) requestSharedAccessToken(ctx context.Context, stale string) (string, error) {
+	providerUrl := client.tokenProviderUrl
+	if stale != "" {
+		providerUrl += "?" + url.Values{"stale": {stale}}.Encode()
+	}
+	request, err := http.NewRequest(http.MethodGet, providerUrl, nil)
+	if err != nil {
+		return "", err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Authorization", "Bearer "+client.tokenProviderToken)
+	response, err := client.httpClient.Do(request)
+	client.log.WithFields(logrus.Fields{"err": err}).Info("从网关获取accessToken请求")
+	if err != nil {
+		return "", &RequestError{Api: "从网关获取accessToken", Err: err}
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", &RequestError{Api: "从网关获取accessToken", Err: err}
+	}
+	client.log.WithFields(logrus.Fields{"StatusCode": response.StatusCode, "body长度": len(body)}).Info("从网关获取accessToken请求")
+	if response.StatusCode != http.StatusOK {
+		return "", &RequestError{Api: "从网关获取accessToken", StatusCode: response.StatusCode}
+	}
+	return string(body), nil
+}
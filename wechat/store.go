@@ -0,0 +1,234 @@
+package wechat
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//accessToken的存储，多副本部署时使用共享的存储，并用刷新锁保证同一时间只有一个副本请求微信
+type TokenStore interface {
+	//获取accessToken，没有时返回空Token
+	Get(ctx context.Context) (Token, error)
+	Set(ctx context.Context, token Token) error
+	//尝试获取刷新锁，ttl后锁自动失效，获取失败返回false
+	Lock(ctx context.Context, ttl time.Duration) (bool, error)
+	//释放本实例持有的刷新锁
+	Unlock(ctx context.Context) error
+}
+
+//随机生成锁的持有者标识
+func newLockOwner() string {
+	data := make([]byte, 16)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//进程内存储，读取不会被进行中的刷新阻塞，单副本部署时使用
+type MemoryTokenStore struct {
+	mutex sync.RWMutex
+	token Token
+}
+
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{}
+}
+
+func (store *MemoryTokenStore) Get(ctx context.Context) (Token, error) {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+	return store.token, nil
+}
+
+func (store *MemoryTokenStore) Set(ctx context.Context, token Token) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	store.token = token
+	return nil
+}
+
+//进程内的并发刷新已经由tokenManager合并，不需要额外加锁
+func (store *MemoryTokenStore) Lock(ctx context.Context, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (store *MemoryTokenStore) Unlock(ctx context.Context) error {
+	return nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//本地文件存储，同一台机器上的多个副本共用，刷新锁是path+".lock"文件
+type FileTokenStore struct {
+	path  string
+	owner string
+}
+
+func NewFileTokenStore(path string) *FileTokenStore {
+	return &FileTokenStore{path: path, owner: newLockOwner()}
+}
+
+func (store *FileTokenStore) Get(ctx context.Context) (Token, error) {
+	data, err := ioutil.ReadFile(store.path)
+	if os.IsNotExist(err) {
+		return Token{}, nil
+	}
+	if err != nil {
+		return Token{}, err
+	}
+	var token Token
+	err = json.Unmarshal(data, &token)
+	return token, err
+}
+
+//先写临时文件再改名，其他副本不会读到写了一半的文件
+func (store *FileTokenStore) Set(ctx context.Context, token Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	file, err := ioutil.TempFile(filepath.Dir(store.path), filepath.Base(store.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	return os.Rename(file.Name(), store.path)
+}
+
+//锁文件内容为"持有者 过期时间"，过期的锁视为已释放
+//锁文件先写好内容再用硬链接创建，已存在时创建失败；打破过期锁时先改名抢走，确认抢到的确实是过期的锁才删除
+func (store *FileTokenStore) Lock(ctx context.Context, ttl time.Duration) (bool, error) {
+	lockPath := store.path + ".lock"
+	for i := 0; i < 2; i++ {
+		locked, err := store.createLock(lockPath, ttl)
+		if locked || err != nil {
+			return locked, err
+		}
+		data, err := ioutil.ReadFile(lockPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		expired, err := lockExpired(lockPath, data, ttl)
+		if err != nil || !expired {
+			return false, err
+		}
+		broken, err := store.breakLock(lockPath, data)
+		if err != nil || !broken {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+//写好内容的临时文件硬链接为锁文件，锁文件已存在时返回false
+func (store *FileTokenStore) createLock(lockPath string, ttl time.Duration) (bool, error) {
+	file, err := ioutil.TempFile(filepath.Dir(lockPath), filepath.Base(lockPath)+".tmp")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(store.owner + " " + strconv.FormatInt(time.Now().Add(ttl).UnixNano(), 10))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return false, err
+	}
+	err = os.Link(file.Name(), lockPath)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//把读到内容为expired的过期锁改名抢走，抢到的是其他副本刚创建的新锁时放回去并返回false
+func (store *FileTokenStore) breakLock(lockPath string, expired []byte) (bool, error) {
+	brokenPath := lockPath + "." + store.owner
+	err := os.Rename(lockPath, brokenPath)
+	if os.IsNotExist(err) {
+		//已被其他副本打破
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(brokenPath)
+	data, err := ioutil.ReadFile(brokenPath)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(data, expired) {
+		return true, nil
+	}
+	err = os.Link(brokenPath, lockPath)
+	if os.IsExist(err) {
+		err = nil
+	}
+	return false, err
+}
+
+//锁文件内容不完整时按修改时间加ttl计算过期时间
+func lockExpired(lockPath string, data []byte, ttl time.Duration) (bool, error) {
+	_, expiresAt := parseLock(data)
+	if expiresAt == 0 {
+		info, err := os.Stat(lockPath)
+		if os.IsNotExist(err) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		expiresAt = info.ModTime().Add(ttl).UnixNano()
+	}
+	return time.Now().UnixNano() >= expiresAt, nil
+}
+
+func (store *FileTokenStore) Unlock(ctx context.Context) error {
+	owner, _, err := store.readLock()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || owner != store.owner {
+		return err
+	}
+	return os.Remove(store.path + ".lock")
+}
+
+func (store *FileTokenStore) readLock() (string, int64, error) {
+	data, err := ioutil.ReadFile(store.path + ".lock")
+	if err != nil {
+		return "", 0, err
+	}
+	owner, expiresAt := parseLock(data)
+	return owner, expiresAt, nil
+}
+
+func parseLock(data []byte) (string, int64) {
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return "", 0
+	}
+	expiresAt, _ := strconv.ParseInt(fields[1], 10, 64)
+	return fields[0], expiresAt
+}
@@ -0,0 +1,131 @@
+package wechat
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//所有副本同时抢锁，返回抢到锁的数量
+func lockConcurrently(stores []TokenStore, ttl time.Duration) int {
+	var locked int
+	var mutex sync.Mutex
+	var wait sync.WaitGroup
+	start := make(chan struct{})
+	for _, store := range stores {
+		wait.Add(1)
+		go func(store TokenStore) {
+			defer wait.Done()
+			<-start
+			ok, err := store.Lock(context.Background(), ttl)
+			if err == nil && ok {
+				mutex.Lock()
+				locked++
+				mutex.Unlock()
+			}
+		}(store)
+	}
+	close(start)
+	wait.Wait()
+	return locked
+}
+
+//检查Set、Get、Lock、Unlock的基本行为，两个store模拟两个副本
+func testTokenStore(t *testing.T, store TokenStore, other TokenStore) {
+	ctx := context.Background()
+	token, err := store.Get(ctx)
+	if err != nil || token.AccessToken != "" {
+		t.Fatalf("空存储返回了 %v %v", token, err)
+	}
+	err = store.Set(ctx, Token{AccessToken: "token", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("写入accessToken失败: %v", err)
+	}
+	token, err = other.Get(ctx)
+	if err != nil || token.AccessToken != "token" {
+		t.Fatalf("另一个副本读到 %v %v", token, err)
+	}
+
+	if locked, err := store.Lock(ctx, time.Minute); err != nil || !locked {
+		t.Fatalf("获取刷新锁失败: %v %v", locked, err)
+	}
+	if locked, err := other.Lock(ctx, time.Minute); err != nil || locked {
+		t.Fatalf("锁被持有时另一个副本也拿到了锁: %v %v", locked, err)
+	}
+	if err := other.Unlock(ctx); err != nil {
+		t.Fatalf("释放别人的锁出错: %v", err)
+	}
+	if locked, err := other.Lock(ctx, time.Minute); err != nil || locked {
+		t.Fatalf("别人的锁被释放了: %v %v", locked, err)
+	}
+	if err := store.Unlock(ctx); err != nil {
+		t.Fatalf("释放锁失败: %v", err)
+	}
+	if locked, err := other.Lock(ctx, time.Minute); err != nil || !locked {
+		t.Fatalf("锁释放后获取失败: %v %v", locked, err)
+	}
+	other.Unlock(ctx)
+
+	if locked, err := store.Lock(ctx, 50*time.Millisecond); err != nil || !locked {
+		t.Fatalf("获取刷新锁失败: %v %v", locked, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if locked, err := other.Lock(ctx, time.Minute); err != nil || !locked {
+		t.Fatalf("锁过期后获取失败: %v %v", locked, err)
+	}
+}
+
+func tempTokenPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "token.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestFileTokenStore(t *testing.T) {
+	path, remove := tempTokenPath(t)
+	defer remove()
+	testTokenStore(t, NewFileTokenStore(path), NewFileTokenStore(path))
+}
+
+//多个副本同时打破同一个过期锁，只能有一个拿到锁
+func TestFileTokenStoreBreakExpiredLock(t *testing.T) {
+	path, remove := tempTokenPath(t)
+	defer remove()
+	for round := 0; round < 50; round++ {
+		expired := "expired " + strconv.FormatInt(time.Now().Add(-time.Second).UnixNano(), 10)
+		if err := ioutil.WriteFile(path+".lock", []byte(expired), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stores := make([]TokenStore, 8)
+		for i := range stores {
+			stores[i] = NewFileTokenStore(path)
+		}
+		if locked := lockConcurrently(stores, time.Minute); locked != 1 {
+			t.Fatalf("第%d轮有%d个副本拿到了锁", round, locked)
+		}
+	}
+}
+
+//打破锁时抢到的是其他副本刚创建的新锁，要原样放回
+func TestFileTokenStoreBreakLockRestoresLiveLock(t *testing.T) {
+	path, remove := tempTokenPath(t)
+	defer remove()
+	holder := NewFileTokenStore(path)
+	if locked, err := holder.Lock(context.Background(), time.Minute); err != nil || !locked {
+		t.Fatalf("获取刷新锁失败: %v %v", locked, err)
+	}
+	broken, err := NewFileTokenStore(path).breakLock(path+".lock", []byte("expired 1"))
+	if err != nil || broken {
+		t.Fatalf("打破了未过期的锁: %v %v", broken, err)
+	}
+	if owner, _, err := holder.readLock(); err != nil || owner != holder.owner {
+		t.Fatalf("锁没有放回: %v %v", owner, err)
+	}
+}
@@ -0,0 +1,81 @@
+package wechat
+
+import (
+	"context"
+	"net/http"
+)
+
+type Tag struct {
+	Id    int    `json:"id"`
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+//获取所有标签
+func (client *Client) ListTags(ctx context.Context) ([]Tag, error) {
+	jsonString, err := client.call(ctx, "获取所有标签", http.MethodGet, "/cgi-bin/tags/get", nil)
+	if err != nil {
+		return nil, err
+	}
+	var tags []Tag
+	err = client.analysisObject("获取所有标签", jsonString, "tags", &tags)
+	return tags, err
+}
+
+//创建标签
+func (client *Client) CreateTag(ctx context.Context, name string) (Tag, error) {
+	jsonString, err := client.call(ctx, "创建标签", http.MethodPost, "/cgi-bin/tags/create", map[string]interface{}{
+		"tag": map[string]string{"name": name},
+	})
+	if err != nil {
+		return Tag{}, err
+	}
+	var tag Tag
+	err = client.analysisObject("创建标签", jsonString, "tag", &tag)
+	return tag, err
+}
+
+//删除标签
+func (client *Client) DeleteTag(ctx context.Context, tagId int) (bool, error) {
+	jsonString, err := client.call(ctx, "删除标签", http.MethodPost, "/cgi-bin/tags/delete", map[string]interface{}{
+		"tag": map[string]interface{}{"id": tagId},
+	})
+	if err != nil {
+		return false, err
+	}
+	return client.analysisSuccess("删除标签", jsonString)
+}
+
+//为用户加标签
+func (client *Client) AddTagToUsers(ctx context.Context, tagId int, openIds []string) (bool, error) {
+	jsonString, err := client.call(ctx, "为用户加标签", http.MethodPost, "/cgi-bin/tags/members/batchtagging", map[string]interface{}{
+		"tagid":       tagId,
+		"openid_list": openIds,
+	})
+	if err != nil {
+		return false, err
+	}
+	return client.analysisSuccess("为用户加标签", jsonString)
+}
+
+//为用户删标签
+func (client *Client) DeleteTagFromUsers(ctx context.Context, tagId int, openIds []string) (bool, error) {
+	jsonString, err := client.call(ctx, "为用户删标签", http.MethodPost, "/cgi-bin/tags/members/batchuntagging", map[string]interface{}{
+		"tagid":       tagId,
+		"openid_list": openIds,
+	})
+	if err != nil {
+		return false, err
+	}
+	return client.analysisSuccess("为用户删标签", jsonString)
+}
+
+//获取标签下openid，超过一页时按next_openid分页获取
+func (client *Client) ListOpenIdsByTag(ctx context.Context, tagId int) ([]string, error) {
+	return client.listOpenIdPages("获取标签下openid", func(nextOpenId string) (string, error) {
+		return client.call(ctx, "获取标签下openid", http.MethodPost, "/cgi-bin/user/tag/get", map[string]interface{}{
+			"tagid":       tagId,
+			"next_openid": nextOpenId,
+		})
+	})
+}
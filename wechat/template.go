@@ -0,0 +1,44 @@
+package wechat
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"net/http"
+)
+
+type Template struct {
+	TemplateId string `json:"template_id"`
+	Title      string `json:"title"`
+}
+
+//获取全部模板
+func (client *Client) ListTemplates(ctx context.Context) ([]Template, error) {
+	jsonString, err := client.call(ctx, "获取所有模板", http.MethodGet, "/cgi-bin/template/get_all_private_template", nil)
+	if err != nil {
+		return nil, err
+	}
+	var templates []Template
+	err = client.analysisObject("获取所有模板", jsonString, "template_list", &templates)
+	return templates, err
+}
+
+//发送模板信息，返回微信的msgid
+func (client *Client) SendTemplate(ctx context.Context, openId string, templateId string, url string, data interface{}) (int64, error) {
+	jsonString, err := client.callOnce(ctx, "发送模板信息", http.MethodPost, "/cgi-bin/message/template/send", map[string]interface{}{
+		"touser":      openId,
+		"template_id": templateId,
+		"url":         url,
+		"data":        data,
+	})
+	if err != nil {
+		return 0, err
+	}
+	_, err = client.analysisSuccess("发送模板", jsonString)
+	if err != nil {
+		return 0, err
+	}
+	msgId := gjson.Get(jsonString, "msgid").Int()
+	client.log.WithFields(logrus.Fields{"openId": openId, "msgId": msgId}).Info("发送模板成功")
+	return msgId, nil
+}
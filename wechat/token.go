@@ -0,0 +1,327 @@
+package wechat
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const DefaultTokenRefreshAhead = 5 * time.Minute
+
+//获取accessToken被微信拒绝后，这段时间内直接返回上次的错误，避免白名单或密钥错误时每次调用都请求上游消耗次数
+//系统繁忙等可重试的错误不缓存
+const tokenFailureWait = time.Minute
+
+//刷新锁的有效时间，持有锁的副本异常退出后其他副本最多等待这么久
+const tokenLockTtl = 10 * time.Second
+
+//accessToken获取方式
+const (
+	//用appId和appSecret请求/cgi-bin/token
+	TokenModeCredential = "credential"
+	//从作为唯一accessToken来源的网关获取
+	TokenModeShared = "shared"
+	//请求/cgi-bin/stable_token，获取新的accessToken不会使之前的失效，适合多个副本各自获取
+	TokenModeStable = "stable"
+)
+
+type Token struct {
+	AccessToken string    `json:"access_token"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+//剩余有效时间
+func (token Token) TTL() time.Duration {
+	return time.Until(token.ExpiresAt)
+}
+
+//accessToken在过期前ahead时间内视为需要刷新
+func (token Token) fresh(ahead time.Duration) bool {
+	return token.AccessToken != "" && time.Now().Add(ahead).Before(token.ExpiresAt)
+}
+
+//errcode表示accessToken失效，需要重新获取
+func isTokenErrCode(errcode int) bool {
+	return errcode == ErrCodeInvalidCredential || errcode == ErrCodeInvalidAccessToken || errcode == ErrCodeAccessTokenExpired
+}
+
+//管理accessToken的缓存和刷新，并发的刷新共用一次上游请求
+type tokenManager struct {
+	client *Client
+	ahead  time.Duration
+	//进程内缓存，每次调用接口都会读取
+	cache *MemoryTokenStore
+	//刷新时读写的存储，多副本部署时为共享存储
+	store TokenStore
+
+	//保护flight和上次失败的结果
+	mutex  sync.Mutex
+	flight *tokenFlight
+	//上次被微信拒绝的错误及其有效期
+	failure   error
+	failUntil time.Time
+}
+
+//一次进行中的刷新
+type tokenFlight struct {
+	done  chan struct{}
+	token Token
+	err   error
+}
+
+func newTokenManager(client *Client, ahead time.Duration, store TokenStore) *tokenManager {
+	if ahead <= 0 {
+		ahead = DefaultTokenRefreshAhead
+	}
+	cache := NewMemoryTokenStore()
+	if store == nil {
+		store = cache
+	}
+	return &tokenManager{client: client, ahead: ahead, cache: cache, store: store}
+}
+
+//获取accessToken，缓存即将过期时刷新
+//过期不代表被微信拒绝，stale传空，只有Client.call收到accessToken失效的errcode时才传stale，避免稳定版模式强制刷新
+func (manager *tokenManager) get(ctx context.Context) (Token, error) {
+	token, _ := manager.cache.Get(ctx)
+	if token.fresh(manager.ahead) {
+		return token, nil
+	}
+	return manager.refresh(ctx, "")
+}
+
+//刷新accessToken，stale是调用方认为已失效的accessToken，缓存已经不是stale时直接返回缓存
+func (manager *tokenManager) refresh(ctx context.Context, stale string) (Token, error) {
+	manager.mutex.Lock()
+	token, _ := manager.cache.Get(ctx)
+	if token.AccessToken != stale && token.fresh(manager.ahead) {
+		manager.mutex.Unlock()
+		return token, nil
+	}
+	if manager.failure != nil && time.Now().Before(manager.failUntil) {
+		err := manager.failure
+		manager.mutex.Unlock()
+		return Token{}, err
+	}
+	flight := manager.flight
+	if flight == nil {
+		flight = &tokenFlight{done: make(chan struct{})}
+		manager.flight = flight
+		go manager.fetch(flight, stale)
+	}
+	manager.mutex.Unlock()
+
+	select {
+	case <-flight.done:
+		return flight.token, flight.err
+	case <-ctx.Done():
+		return Token{}, ctx.Err()
+	}
+}
+
+//获取新的accessToken，不受单个调用方ctx取消的影响
+func (manager *tokenManager) fetch(flight *tokenFlight, stale string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*tokenLockTtl)
+	defer cancel()
+	flight.token, flight.err = manager.fetchFromStore(ctx, stale)
+	manager.mutex.Lock()
+	if flight.err == nil {
+		manager.cache.Set(ctx, flight.token)
+		manager.failure = nil
+	} else if weChatError, ok := AsWeChatError(flight.err); ok && !IsRetryable(weChatError) {
+		manager.failure = flight.err
+		manager.failUntil = time.Now().Add(tokenFailureWait)
+	}
+	manager.flight = nil
+	manager.mutex.Unlock()
+	close(flight.done)
+}
+
+//先看存储里是否已有其他副本刷新好的accessToken，没有时拿到刷新锁的副本请求上游，其他副本等待它写入存储
+func (manager *tokenManager) fetchFromStore(ctx context.Context, stale string) (Token, error) {
+	for {
+		token, err := manager.store.Get(ctx)
+		if err != nil {
+			manager.client.log.WithFields(logrus.Fields{"err": err}).Error("读取accessToken存储失败，直接请求上游")
+			return manager.client.fetchAccessToken(ctx, stale)
+		}
+		if token.AccessToken != stale && token.fresh(manager.ahead) {
+			return token, nil
+		}
+		locked, err := manager.store.Lock(ctx, tokenLockTtl)
+		if err != nil {
+			manager.client.log.WithFields(logrus.Fields{"err": err}).Error("获取accessToken刷新锁失败，直接请求上游")
+			return manager.client.fetchAccessToken(ctx, stale)
+		}
+		if locked {
+			return manager.fetchLocked(ctx, stale)
+		}
+		manager.client.log.Info("其他副本正在刷新accessToken，等待")
+		select {
+		case <-ctx.Done():
+			return Token{}, errors.New("等待其他副本刷新accessToken超时")
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func (manager *tokenManager) fetchLocked(ctx context.Context, stale string) (Token, error) {
+	defer manager.store.Unlock(ctx)
+	//拿锁之前其他副本可能刚刷新完
+	token, err := manager.store.Get(ctx)
+	if err == nil && token.AccessToken != stale && token.fresh(manager.ahead) {
+		return token, nil
+	}
+	token, err = manager.client.fetchAccessToken(ctx, stale)
+	if err != nil {
+		return Token{}, err
+	}
+	if err := manager.store.Set(ctx, token); err != nil {
+		manager.client.log.WithFields(logrus.Fields{"err": err}).Error("写入accessToken存储失败")
+	}
+	return token, nil
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//获取accessToken及其过期时间
+func (client *Client) AccessToken(ctx context.Context) (Token, error) {
+	return client.tokenManager.get(ctx)
+}
+
+//强制刷新accessToken，stale是调用方认为已失效的accessToken，已被其他调用刷新时直接返回新的accessToken
+func (client *Client) RefreshAccessToken(ctx context.Context, stale string) (Token, error) {
+	return client.tokenManager.refresh(ctx, stale)
+}
+
+//在accessToken过期前自动刷新，直到ctx结束
+func (client *Client) AutoFlushAccessToken(ctx context.Context) {
+	for {
+		wait := tokenFailureWait
+		token, err := client.AccessToken(ctx)
+		if err == nil {
+			wait = token.TTL() - client.tokenManager.ahead
+		} else {
+			client.log.WithFields(logrus.Fields{"err": err}).Error("自动刷新accessToken失败")
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (client *Client) fetchAccessToken(ctx context.Context, stale string) (Token, error) {
+	switch client.tokenMode {
+	case TokenModeShared:
+		return client.flushSharedAccessToken(ctx, stale)
+	case TokenModeStable:
+		return client.flushStableAccessToken(ctx, stale)
+	default:
+		return client.flushAccessToken(ctx)
+	}
+}
+
+func (client *Client) flushAccessToken(ctx context.Context) (Token, error) {
+	var err error
+	for i := 0; i < client.retry; i++ {
+		var jsonString string
+		jsonString, err = client.requestAccessToken(ctx)
+		if err == nil {
+			return client.analysisAccessToken(jsonString)
+		}
+	}
+	return Token{}, err
+}
+
+//获取稳定版accessToken，普通模式取回的仍是stale时才强制刷新，强制刷新每天有次数限制
+func (client *Client) flushStableAccessToken(ctx context.Context, stale string) (Token, error) {
+	token, err := client.flushStableAccessTokenOnce(ctx, false)
+	if err != nil || stale == "" || token.AccessToken != stale {
+		return token, err
+	}
+	client.log.Warn("稳定版accessToken已失效，强制刷新")
+	return client.flushStableAccessTokenOnce(ctx, true)
+}
+
+func (client *Client) flushStableAccessTokenOnce(ctx context.Context, forceRefresh bool) (Token, error) {
+	var err error
+	for i := 0; i < client.retry; i++ {
+		var jsonString string
+		jsonString, err = client.requestStableAccessToken(ctx, forceRefresh)
+		if err == nil {
+			return client.analysisAccessToken(jsonString)
+		}
+	}
+	return Token{}, err
+}
+
+func (client *Client) analysisAccessToken(jsonString string) (Token, error) {
+	if !gjson.Valid(jsonString) {
+		client.log.Error("获取accessToken响应json非法")
+		return Token{}, errors.New("获取accessToken响应json非法")
+	}
+	if err := client.analysisError("获取accessToken", jsonString); err != nil {
+		return Token{}, err
+	}
+	result := gjson.Get(jsonString, "access_token")
+	if !result.Exists() {
+		client.log.Error("获取accessToken响应json没有access_token属性")
+		return Token{}, errors.New("获取accessToken响应json没有access_token属性")
+	}
+	expiresIn := gjson.Get(jsonString, "expires_in").Int()
+	if expiresIn <= 0 {
+		expiresIn = 7200
+	}
+	token := Token{
+		AccessToken: result.String(),
+		ExpiresAt:   time.Now().Add(time.Duration(expiresIn) * time.Second),
+	}
+	client.log.WithFields(logrus.Fields{"accessToken": len(token.AccessToken), "expiresAt": token.ExpiresAt}).Info("accessToken长度")
+	return token, nil
+}
+
+func (client *Client) requestAccessToken(ctx context.Context) (string, error) {
+	params := url.Values{
+		"appid":      {client.appId},
+		"secret":     {client.appSecret},
+		"grant_type": {"client_credential"},
+	}
+	statusCode, body, err := client.send(ctx, http.MethodGet, "/cgi-bin/token", params, nil)
+	client.log.WithFields(logrus.Fields{"err": err}).Info("获取accessToken请求")
+	if err != nil {
+		return "", &RequestError{Api: "获取accessToken", Err: err}
+	}
+	client.log.WithFields(logrus.Fields{"StatusCode": statusCode, "body长度": len(body)}).Info("获取accessToken请求")
+	if statusCode != http.StatusOK {
+		return "", &RequestError{Api: "获取accessToken", StatusCode: statusCode}
+	}
+	return body, nil
+}
+
+func (client *Client) requestStableAccessToken(ctx context.Context, forceRefresh bool) (string, error) {
+	statusCode, body, err := client.send(ctx, http.MethodPost, "/cgi-bin/stable_token", url.Values{}, map[string]interface{}{
+		"grant_type":    "client_credential",
+		"appid":         client.appId,
+		"secret":        client.appSecret,
+		"force_refresh": forceRefresh,
+	})
+	client.log.WithFields(logrus.Fields{"err": err, "forceRefresh": forceRefresh}).Info("获取稳定版accessToken请求")
+	if err != nil {
+		return "", &RequestError{Api: "获取稳定版accessToken", Err: err}
+	}
+	client.log.WithFields(logrus.Fields{"StatusCode": statusCode, "body长度": len(body)}).Info("获取稳定版accessToken请求")
+	if statusCode != http.StatusOK {
+		return "", &RequestError{Api: "获取稳定版accessToken", StatusCode: statusCode}
+	}
+	return body, nil
+}
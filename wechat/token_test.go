@@ -0,0 +1,85 @@
+package wechat
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+	"wxGateway/mock"
+)
+
+//启动模拟微信接口服务，返回指向它的客户端，用完调用closeServer关闭服务
+func newMockClient(config Config) (client *Client, server *mock.Server, closeServer func()) {
+	gin.SetMode(gin.TestMode)
+	server = mock.NewServer("appId", "appSecret")
+	server.AddTemplate("template", "模板")
+	httpServer := httptest.NewServer(server.Handler())
+
+	logger := logrus.New()
+	logger.SetOutput(ioutil.Discard)
+	config.AppId = "appId"
+	config.AppSecret = "appSecret"
+	config.ApiUrl = httpServer.URL
+	config.Logger = logger
+	return NewClient(config), server, httpServer.Close
+}
+
+//并发发送模板消息的同时不断刷新和作废accessToken，用go test -race检查数据竞争
+func TestSendTemplateWhileRefreshing(t *testing.T) {
+	client, server, closeServer := newMockClient(Config{Retry: 10})
+	defer closeServer()
+	server.AddUser("openId", "user")
+	ctx := context.Background()
+
+	const senders = 8
+	const sends = 50
+	done := make(chan struct{})
+	var refresher sync.WaitGroup
+	refresher.Add(1)
+	go func() {
+		defer refresher.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			if i%2 == 0 {
+				server.InvalidateAccessToken()
+				continue
+			}
+			token, err := client.AccessToken(ctx)
+			if err != nil {
+				t.Errorf("获取accessToken失败: %v", err)
+				continue
+			}
+			if _, err := client.RefreshAccessToken(ctx, token.AccessToken); err != nil {
+				t.Errorf("刷新accessToken失败: %v", err)
+			}
+		}
+	}()
+
+	var wait sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for j := 0; j < sends; j++ {
+				if _, err := client.SendTemplate(ctx, "openId", "template", "", map[string]interface{}{}); err != nil {
+					t.Errorf("发送模板消息失败: %v", err)
+				}
+			}
+		}()
+	}
+	wait.Wait()
+	close(done)
+	refresher.Wait()
+
+	if sent := len(server.SentTemplates()); sent != senders*sends {
+		t.Fatalf("发送了%d条模板消息，期望%d条", sent, senders*sends)
+	}
+}
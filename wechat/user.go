@@ -0,0 +1,75 @@
+package wechat
+
+import (
+	"context"
+	"github.com/tidwall/gjson"
+	"net/http"
+	"net/url"
+)
+
+type UserInfo struct {
+	OpenId    string `json:"openid"`
+	Nickname  string `json:"nickname"`
+	TagIdList []int  `json:"tagid_list"`
+}
+
+//获取全部openId，超过一页时按next_openid分页获取
+func (client *Client) ListOpenIds(ctx context.Context) ([]string, error) {
+	return client.listOpenIdPages("获取全部openId", func(nextOpenId string) (string, error) {
+		return client.call(ctx, "获取全部openId", http.MethodGet, "/cgi-bin/user/get?next_openid="+url.QueryEscape(nextOpenId), nil)
+	})
+}
+
+//微信每页最多返回10000个openid，没有更多时返回的count为0且没有data
+func (client *Client) listOpenIdPages(name string, fetch func(nextOpenId string) (string, error)) ([]string, error) {
+	openIds := []string{}
+	nextOpenId := ""
+	for {
+		jsonString, err := fetch(nextOpenId)
+		if err != nil {
+			return nil, err
+		}
+		if err := client.analysisError(name, jsonString); err != nil {
+			return nil, err
+		}
+		if gjson.Get(jsonString, "count").Int() == 0 {
+			return openIds, nil
+		}
+		var page []string
+		err = client.analysisObject(name, jsonString, "data.openid", &page)
+		if err != nil {
+			return nil, err
+		}
+		openIds = append(openIds, page...)
+		nextOpenId = gjson.Get(jsonString, "next_openid").String()
+		if nextOpenId == "" {
+			return openIds, nil
+		}
+	}
+}
+
+//获取用户信息
+func (client *Client) ListUserInfos(ctx context.Context, openIds []string) ([]UserInfo, error) {
+	var userList []map[string]interface{}
+	for i := range openIds {
+		userList = append(userList, map[string]interface{}{"openid": openIds[i], "lang": "zh_CN"})
+	}
+	jsonString, err := client.call(ctx, "获取用户信息", http.MethodPost, "/cgi-bin/user/info/batchget", map[string]interface{}{
+		"user_list": userList,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var userInfos []UserInfo
+	err = client.analysisObject("获取用户信息", jsonString, "user_info_list", &userInfos)
+	return userInfos, err
+}
+
+//获取全部用户信息
+func (client *Client) ListAllUserInfos(ctx context.Context) ([]UserInfo, error) {
+	openIds, err := client.ListOpenIds(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.ListUserInfos(ctx, openIds)
+}
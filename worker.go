@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+	"math/rand"
+	"sync"
+	"time"
+	"wxGateway/wechat"
+)
+
+//同时发送模板消息的协程数
+var sendConcurrency = 4
+
+//所有任务共享的每分钟发送上限
+var sendRatePerMinute = 600
+
+//触发微信频率限制后暂停发送的时间，连续触发时翻倍
+var throttleBackoff = time.Second
+var maxThrottleBackoff = time.Minute
+
+//同一个用户遇到可重试错误时最多重试的次数
+var sendRetry = 5
+
+//网络异常和系统繁忙时同一个用户的重试间隔，从sendRetryBackoff开始翻倍并加上随机抖动
+var sendRetryBackoff = time.Second
+var maxSendRetryBackoff = 30 * time.Second
+
+//全局发送限速，微信返回频率限制时所有协程一起暂停
+type sendThrottle struct {
+	limiter     *rate.Limiter
+	mutex       sync.Mutex
+	backoff     time.Duration
+	pausedUntil time.Time
+}
+
+var throttle *sendThrottle
+
+func newSendThrottle(ratePerMinute int) *sendThrottle {
+	limit := rate.Limit(float64(ratePerMinute) / 60)
+	return &sendThrottle{limiter: rate.NewLimiter(limit, 1)}
+}
+
+//等待暂停结束并取得发送额度
+func (throttle *sendThrottle) wait(ctx context.Context) error {
+	throttle.mutex.Lock()
+	pause := time.Until(throttle.pausedUntil)
+	throttle.mutex.Unlock()
+	if pause > 0 {
+		timer := time.NewTimer(pause)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return throttle.limiter.Wait(ctx)
+}
+
+//触发频率限制，暂停时间从throttleBackoff开始翻倍
+func (throttle *sendThrottle) throttled() time.Duration {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	if time.Now().Before(throttle.pausedUntil) {
+		return time.Until(throttle.pausedUntil)
+	}
+	if throttle.backoff == 0 {
+		throttle.backoff = throttleBackoff
+	} else if throttle.backoff < maxThrottleBackoff {
+		throttle.backoff *= 2
+		if throttle.backoff > maxThrottleBackoff {
+			throttle.backoff = maxThrottleBackoff
+		}
+	}
+	throttle.pausedUntil = time.Now().Add(throttle.backoff)
+	return throttle.backoff
+}
+
+func (throttle *sendThrottle) succeeded() {
+	throttle.mutex.Lock()
+	defer throttle.mutex.Unlock()
+	throttle.backoff = 0
+}
+
+func isThrottleErrCode(err error) bool {
+	errCode, ok := wechat.ErrCode(err)
+	return ok && (errCode == wechat.ErrCodeApiFreqOutOfLimit || errCode == wechat.ErrCodeOutOfResponseCount)
+}
+
+//----------------------------------------------------------------------------------------------------------------------
+
+//用sendConcurrency个协程发送任务中的模板消息，任务被取消后不再取新的用户
+func sendJobRecipients(ctx context.Context, job *Job) {
+	recipients := make(chan *JobRecipient)
+	var wait sync.WaitGroup
+	for i := 0; i < sendConcurrency; i++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for recipient := range recipients {
+				msgId, err := sendJobTemplate(ctx, job, recipient.OpenId)
+				if err == context.Canceled {
+					continue
+				}
+				job.finishRecipient(recipient, msgId, err)
+				recordMessage(MessageRecord{
+					Type:       MessageTypeTemplate,
+					OpenId:     recipient.OpenId,
+					TemplateId: job.TemplateId,
+					Url:        job.Url,
+					Data:       job.Data,
+					JobId:      job.Id,
+					MsgId:      msgId,
+				}, err)
+				if err != nil {
+					deadLetters.park(job, recipient.OpenId, err)
+				}
+			}
+		}()
+	}
+feed:
+	for i := range job.Recipients {
+		select {
+		case recipients <- job.Recipients[i]:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(recipients)
+	wait.Wait()
+}
+
+//限速发送一条模板消息，可重试的错误重试sendRetry次
+//触发频率限制时所有协程一起暂停，网络异常和系统繁忙时只有这个用户退避后重试
+func sendJobTemplate(ctx context.Context, job *Job, openId string) (int64, error) {
+	for i := 0; ; i++ {
+		err := throttle.wait(ctx)
+		if err != nil {
+			return 0, err
+		}
+		msgId, err := client.SendTemplate(context.Background(), openId, job.TemplateId, job.Url, job.Data)
+		if err == nil {
+			throttle.succeeded()
+			return msgId, nil
+		}
+		if !wechat.IsRetryable(err) || i >= sendRetry {
+			return 0, err
+		}
+		if isThrottleErrCode(err) {
+			pause := throttle.throttled()
+			log.WithFields(logrus.Fields{"id": job.Id, "openId": openId, "pause": pause, "err": err}).Warn("触发微信频率限制，暂停发送")
+			continue
+		}
+		backoff := jitteredBackoff(sendRetryBackoff, maxSendRetryBackoff, i)
+		log.WithFields(logrus.Fields{"id": job.Id, "openId": openId, "backoff": backoff, "err": err}).Warn("发送模板消息失败，退避后重试")
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+//第attempt次重试的退避时间，在base*2^attempt的一半到全部之间随机
+func jitteredBackoff(base time.Duration, max time.Duration, attempt int) time.Duration {
+	backoff := base << uint(attempt)
+	if backoff > max || backoff <= 0 {
+		backoff = max
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+	"wxGateway/mock"
+	"wxGateway/wechat"
+)
+
+//用模拟微信接口和临时数据库初始化发送用到的全局变量，ratePerMinute为网关的发送上限
+func setupSend(t testing.TB, ratePerMinute int) (*mock.Server, func()) {
+	gin.SetMode(gin.TestMode)
+	log.SetOutput(ioutil.Discard)
+	server := mock.NewServer("appId", "appSecret")
+	server.AddTemplate("template", "模板")
+	httpServer := httptest.NewServer(server.Handler())
+
+	dir, err := ioutil.TempDir("", "wxGateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "wxGateway.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err == nil {
+		messages, err = newMessageStore(db)
+	}
+	if err == nil {
+		deadLetters, err = newDeadLetterStore(db)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttle = newSendThrottle(ratePerMinute)
+	client = wechat.NewClient(wechat.Config{AppId: "appId", AppSecret: "appSecret", ApiUrl: httpServer.URL, Logger: log})
+	return server, func() {
+		httpServer.Close()
+		db.Close()
+		os.RemoveAll(dir)
+		log.SetOutput(os.Stderr)
+	}
+}
+
+//创建发给n个用户的任务，用户都添加到模拟接口中
+func newSendJob(server *mock.Server, n int) *Job {
+	openIds := make([]string, n)
+	for i := range openIds {
+		openIds[i] = "openId" + strconv.Itoa(i)
+		server.AddUser(openIds[i], "user")
+	}
+	job := &Job{Id: newJobId(), TemplateId: "template", Data: map[string]map[string]string{"first": {"value": "你好"}}}
+	job.setRecipients(openIds)
+	return job
+}
+
+//把触发频率限制后的暂停时间改短，重试次数改大，返回恢复原值的函数
+func shortenThrottleBackoff() func() {
+	backoff, maxBackoff, retry := throttleBackoff, maxThrottleBackoff, sendRetry
+	throttleBackoff = 50 * time.Millisecond
+	maxThrottleBackoff = time.Second
+	sendRetry = 1000
+	return func() {
+		throttleBackoff, maxThrottleBackoff, sendRetry = backoff, maxBackoff, retry
+	}
+}
+
+//检查任务的每个用户都发送成功，返回模拟接口返回45009的次数
+func checkAllSent(t testing.TB, server *mock.Server, job *Job) int {
+	snapshot := job.snapshot()
+	for _, recipient := range snapshot.Recipients {
+		if recipient.Status != RecipientStatusSent {
+			t.Fatalf("用户%s的状态为%s: %s", recipient.OpenId, recipient.Status, recipient.ErrMsg)
+		}
+	}
+	if sent := len(server.SentTemplates()); sent != len(snapshot.Recipients) {
+		t.Fatalf("模拟接口收到%d条，期望%d条", sent, len(snapshot.Recipients))
+	}
+	return server.ThrottledTemplates()
+}
+
+//网关限速高于微信的频率限制，触发45009后全局暂停并重试，最终全部发送成功
+func TestSendJobRecipientsThrottled(t *testing.T) {
+	server, teardown := setupSend(t, 6000000)
+	defer teardown()
+	defer shortenThrottleBackoff()()
+	server.LimitTemplateRate(5)
+	//不限速时发送很快，最多跨过一个整秒，超过两秒的额度一定会触发
+	job := newSendJob(server, 12)
+	sendJobRecipients(context.Background(), job)
+	if throttled := checkAllSent(t, server, job); throttled == 0 {
+		t.Fatal("超过频率限制时没有触发45009")
+	}
+}
+
+//网关限速低于微信的频率限制时不应触发45009
+func TestSendJobRecipientsBelowLimit(t *testing.T) {
+	server, teardown := setupSend(t, 8*60)
+	defer teardown()
+	server.LimitTemplateRate(10)
+	job := newSendJob(server, 12)
+	sendJobRecipients(context.Background(), job)
+	if throttled := checkAllSent(t, server, job); throttled != 0 {
+		t.Fatalf("限速低于频率限制时触发了%d次45009", throttled)
+	}
+}
+
+//发送b.N条模板消息，报告每秒发送的条数
+func runSendBenchmark(b *testing.B, server *mock.Server) {
+	job := newSendJob(server, b.N)
+	b.ResetTimer()
+	start := time.Now()
+	sendJobRecipients(context.Background(), job)
+	elapsed := time.Since(start)
+	b.StopTimer()
+	checkAllSent(b, server, job)
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "msgs/sec")
+}
+
+//不限速时的发送吞吐量
+func BenchmarkSendJobRecipients(b *testing.B) {
+	server, teardown := setupSend(b, 6000000)
+	defer teardown()
+	runSendBenchmark(b, server)
+}
+
+//网关限速低于微信的频率限制时的吞吐量
+func BenchmarkSendJobRecipientsBelowLimit(b *testing.B) {
+	server, teardown := setupSend(b, 40*60)
+	defer teardown()
+	server.LimitTemplateRate(50)
+	runSendBenchmark(b, server)
+}
+
+//触发频率限制后暂停重试时的吞吐量
+func BenchmarkSendJobRecipientsThrottled(b *testing.B) {
+	server, teardown := setupSend(b, 6000000)
+	defer teardown()
+	defer shortenThrottleBackoff()()
+	server.LimitTemplateRate(20)
+	runSendBenchmark(b, server)
+	b.ReportMetric(float64(server.ThrottledTemplates())/float64(b.N), "throttled/op")
+}